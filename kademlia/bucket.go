@@ -2,44 +2,133 @@ package kademlia
 
 import (
 	"container/list"
+	"time"
 )
 
+const replacementCacheSize = 10 // Contacts kept aside for when the bucket is full
+const deadContactFailures = 2   // Consecutive RPC failures after which a contact is considered dead
+const maxContactFailures = 3    // Consecutive RPC failures after which a contact is evicted
+const rttSmoothing = 8          // Weight of the history against a new sample in the smoothed RTT
+
 // bucket definition
-// contains a List
+// contains a List of at most size contacts, a List, the replacement
+// cache, of the most recently seen contacts that did not fit in it, and
+// the last time it was used. Its range is made of the IDs starting with
+// the depth leading bits of prefix
 type bucket struct {
-	list *list.List
+	list         *list.List
+	replacements *list.List
+	lastUsed     time.Time // Last time a lookup targeted the range of the bucket
+	prefix       KademliaID
+	depth        int
+	size         int
 }
 
-// newBucket returns a new instance of a bucket
-func newBucket() *bucket {
-	bucket := &bucket{}
+// newBucket returns a new instance of a bucket with the range and the size specified
+func newBucket(prefix KademliaID, depth int, size int) *bucket {
+	bucket := &bucket{prefix: prefix, depth: depth, size: size}
 	bucket.list = list.New()
+	bucket.replacements = list.New()
 	return bucket
 }
 
-// AddContact adds the Contact to the front of the bucket
-// or moves it to the front of the bucket if it already existed
-func (bucket *bucket) AddContact(contact Contact) bool {
-	var element *list.Element
-	for e := bucket.list.Front(); e != nil; e = e.Next() {
-		nodeID := e.Value.(Contact).ID
+// RandomID returns a random ID in the range of the bucket
+func (bucket *bucket) RandomID() *KademliaID {
+	id := NewRandomKademliaID()
+	for i := 0; i < bucket.depth; i++ { // Copy the prefix bit by bit
+		mask := byte(0x80) >> uint(i%8)
+		id[i/8] = id[i/8]&^mask | bucket.prefix[i/8]&mask
+	}
+	return id
+}
+
+// Covers returns true if the ID specified is in the range of the bucket
+func (bucket *bucket) Covers(id *KademliaID) bool {
+	return commonPrefixLen(&bucket.prefix, id) >= bucket.depth
+}
 
-		if (contact).ID.Equals(nodeID) {
-			element = e
+// minDistance returns the lowest distance from the target to an ID in the range of the bucket
+func (bucket *bucket) minDistance(target *KademliaID) KademliaID {
+	distance := *bucket.prefix.CalcDistance(target)
+	if bucket.depth == IDLength*8 {
+		return distance
+	}
+	distance[bucket.depth/8] &^= 0xff >> uint(bucket.depth%8) // The rest of the bits can match the target
+	for i := bucket.depth/8 + 1; i < IDLength; i++ {
+		distance[i] = 0
+	}
+	return distance
+}
+
+// split divides the bucket in two halves at its next bit, the contacts and the
+// replacements going to the half whose range includes them in the same order
+func (bucket *bucket) split() (low, high *bucket) {
+	low, high = newBucket(bucket.prefix, bucket.depth+1, bucket.size), newBucket(bucket.prefix, bucket.depth+1, bucket.size)
+	mask := byte(0x80) >> uint(bucket.depth%8)
+	low.prefix[bucket.depth/8] &^= mask
+	high.prefix[bucket.depth/8] |= mask
+	low.lastUsed, high.lastUsed = bucket.lastUsed, bucket.lastUsed
+	for e := bucket.list.Front(); e != nil; e = e.Next() {
+		if high.Covers(e.Value.(Contact).ID) {
+			high.list.PushBack(e.Value)
+		} else {
+			low.list.PushBack(e.Value)
 		}
 	}
+	for e := bucket.replacements.Front(); e != nil; e = e.Next() {
+		if high.Covers(e.Value.(Contact).ID) {
+			high.replacements.PushBack(e.Value)
+		} else {
+			low.replacements.PushBack(e.Value)
+		}
+	}
+	return low, high
+}
+
+// AddContact adds the Contact to the front of the bucket
+// or moves it to the front of the bucket if it already existed,
+// merging its liveness metadata. If the bucket is full, the
+// Contact is added to the front of the replacement cache instead. A
+// Contact whose ID is known at another address is ignored, the one
+// known is kept until it fails
+func (bucket *bucket) AddContact(contact Contact) bool {
+	element := bucket.find(contact.ID)
+	if element != nil && !sameAddress(element.Value.(Contact).Address, contact.Address) {
+		return false
+	}
 
 	if element == nil {
-		if bucket.list.Len() < bucketSize {
+		if bucket.list.Len() < bucket.size {
+			contact.Failures = 0
 			bucket.list.PushFront(contact)
+			bucket.removeReplacement(contact.ID)
 			return true
 		}
+		bucket.addReplacement(contact)
 	} else {
+		element.Value = merge(element.Value.(Contact), contact)
 		bucket.list.MoveToFront(element)
 	}
 	return false
 }
 
+// Fail records an RPC that the Contact failed to answer, unless the bucket knows
+// its ID at another address. Once it fails maxContactFailures times in a row, it
+// is evicted as Remove does. It returns true if the Contact is evicted
+func (bucket *bucket) Fail(contact Contact) bool {
+	element := bucket.findAt(contact)
+	if element == nil {
+		return false
+	}
+	stored := element.Value.(Contact)
+	stored.Failures++
+	if stored.Failures < maxContactFailures {
+		element.Value = stored
+		return false
+	}
+	return bucket.Remove(contact.ID)
+}
+
 // GetContactAndCalcDistance returns an array of Contacts where
 // the distance has already been calculated
 func (bucket *bucket) GetContactAndCalcDistance(target *KademliaID) []Contact {
@@ -58,3 +147,124 @@ func (bucket *bucket) GetContactAndCalcDistance(target *KademliaID) []Contact {
 func (bucket *bucket) Len() int {
 	return bucket.list.Len()
 }
+
+// Contains returns true if the Contact with the ID specified is in the bucket
+func (bucket *bucket) Contains(id *KademliaID) bool {
+	return bucket.find(id) != nil
+}
+
+// Remove removes the Contact with the ID specified from the bucket, leaving the
+// promotion of a replacement in its place to the RoutingTable, which checks it
+// against the diversity limits. It returns false if it was not in the bucket
+func (bucket *bucket) Remove(id *KademliaID) bool {
+	element := bucket.find(id)
+	if element == nil {
+		return false
+	}
+	bucket.list.Remove(element)
+	return true
+}
+
+// Replacements returns a copy of the Contacts in the replacement cache,
+// from the most to the least recently seen
+func (bucket *bucket) Replacements() []Contact {
+	return contactsOf(bucket.replacements)
+}
+
+// Contacts returns a copy of the Contacts in the bucket, from the
+// most to the least recently seen
+func (bucket *bucket) Contacts() []Contact {
+	return contactsOf(bucket.list)
+}
+
+// addReplacement adds the Contact to the front of the replacement cache, or moves
+// it there if it was already cached, dropping the least recently seen when full
+func (bucket *bucket) addReplacement(contact Contact) {
+	if element := findIn(bucket.replacements, contact.ID); element != nil {
+		if !sameAddress(element.Value.(Contact).Address, contact.Address) {
+			return
+		}
+		contact = merge(element.Value.(Contact), contact)
+		bucket.replacements.Remove(element)
+	}
+	contact.Failures = 0
+	bucket.replacements.PushFront(contact)
+	if bucket.replacements.Len() > replacementCacheSize {
+		bucket.replacements.Remove(bucket.replacements.Back())
+	}
+}
+
+// removeReplacement removes the Contact with the ID specified from the replacement cache
+func (bucket *bucket) removeReplacement(id *KademliaID) {
+	if element := findIn(bucket.replacements, id); element != nil {
+		bucket.replacements.Remove(element)
+	}
+}
+
+// find returns the element of the list holding the Contact with the ID specified, if any
+func (bucket *bucket) find(id *KademliaID) *list.Element {
+	return findIn(bucket.list, id)
+}
+
+// findAt returns the element of the list holding the Contact with the ID of the one
+// specified, if it is known at its address too. An ID is only hearsay until then
+func (bucket *bucket) findAt(contact Contact) *list.Element {
+	element := bucket.find(contact.ID)
+	if element == nil || !sameAddress(element.Value.(Contact).Address, contact.Address) {
+		return nil
+	}
+	return element
+}
+
+// findIn returns the element of l holding the Contact with the ID specified, if any
+func findIn(l *list.List, id *KademliaID) *list.Element {
+	for e := l.Front(); e != nil; e = e.Next() {
+		if e.Value.(Contact).ID.Equals(id) {
+			return e
+		}
+	}
+	return nil
+}
+
+// contactsOf returns a copy of the Contacts in l, in order
+func contactsOf(l *list.List) []Contact {
+	contacts := make([]Contact, 0, l.Len())
+	for elt := l.Front(); elt != nil; elt = elt.Next() {
+		contacts = append(contacts, elt.Value.(Contact))
+	}
+	return contacts
+}
+
+// merge returns the stored Contact updated with a new sighting of it: the times are
+// advanced, the round-trip time sample is folded into the smoothed one and the
+// failures are cleared. A sighting without times only refreshes its position
+func merge(stored Contact, seen Contact) Contact {
+	stored.Failures = 0
+	if seen.LastSeen.After(stored.LastSeen) {
+		stored.LastSeen = seen.LastSeen
+	}
+	if seen.LastReplied.After(stored.LastReplied) {
+		stored.LastReplied = seen.LastReplied
+		if stored.RTT == 0 {
+			stored.RTT = seen.RTT
+		} else if seen.RTT != 0 {
+			stored.RTT += (seen.RTT - stored.RTT) / rttSmoothing
+		}
+	}
+	return stored
+}
+
+// commonPrefixLen returns the number of leading bits shared by both IDs
+func commonPrefixLen(a, b *KademliaID) int {
+	for i := 0; i < IDLength; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+	return IDLength * 8
+}
@@ -0,0 +1,27 @@
+package kademlia
+
+import (
+	"time"
+)
+
+// Clock definition
+// provides the current time and timers to the periodic routines of the node and dates
+// the values it stores, so that they can be driven by something other than the system clock
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// After returns a channel that receives the current time once d has elapsed
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock definition
+// implements the Clock interface with the system clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,129 @@
+package kademlia
+
+import (
+	"fmt"
+	"time"
+)
+
+// Default values of the parameters of Config
+const concurrencyParam = 3    // Alpha definition
+const replicationParam = 20   // K definition
+const bucketSize = 20         // Contacts per bucket
+const republishDelayHr = 24   // Delay for the republishing routines
+const expirationDelayHr = 24  // Delay for the expiration routines
+const refreshIntervalHr = 1   // Delay after which a bucket not used by any lookup is refreshed
+const replicateIntervalHr = 1 // Delay after which a value not stored again is replicated
+const pingTimeoutSec = 3      // Timeout for the PING RPC
+const findTimeoutSec = 20     // Timeout for the FIND_NODE and FIND_VALUE RPCs
+const storeTimeoutSec = 10    // Timeout for the STORE RPC
+const stallTimeoutMs = 500    // Time after which an unanswered lookup RPC stops occupying one of the alpha slots
+const bufferSize = 8192       // Size of the buffer receiving the messages
+const chunkSize = 4096        // Size of the chunks of the large objects
+
+const maxContactSize = fieldHeaderSize + IDLength + 2 + len("ffff:ffff:ffff:ffff:ffff:ffff:255.255.255.255")
+const storeOverhead = headerSize + 2*fieldHeaderSize + ttlSize // A STORE carries a value and its time to live
+
+// Config definition
+// holds the protocol parameters of a node. The zero value of a parameter selects its
+// default, so that Config{} describes a node as the paper does
+type Config struct {
+	Alpha             int             // Concurrency of the lookups
+	K                 int             // Contacts returned by the lookups and nodes storing each value
+	BucketSize        int             // Contacts per bucket of the routing table
+	RepublishDelay    time.Duration   // Delay after which the values published by the node are published again
+	ExpirationDelay   time.Duration   // Delay after which a value that is not refreshed is deleted
+	RefreshInterval   time.Duration   // Delay after which a bucket not used by any lookup is refreshed
+	ReplicateInterval time.Duration   // Delay after which a value held by the node and not stored again is replicated
+	PingTimeout       time.Duration   // Timeout for the PING RPC
+	FindTimeout       time.Duration   // Timeout for the FIND_NODE and FIND_VALUE RPCs
+	StoreTimeout      time.Duration   // Timeout for the STORE RPC
+	StallTimeout      time.Duration   // Time after which an unanswered lookup RPC stops occupying one of the alpha slots
+	BufferSize        int             // Size of the buffer receiving the messages
+	ChunkSize         int             // Size of the chunks of the large objects, and largest value stored as is
+	TreeRoutes        bool            // Tree layout for the routing table, see NewTreeRoutingTable
+	RelaxedDepth      int             // Relaxed splitting of the tree layout, see NewTreeRoutingTable
+	Diversity         DiversityLimits // Limits on the contacts sharing an IP address or a subnet
+	Clock             Clock           // Drives the periodic routines and dates the values, the system clock if nil
+	Store             Store           // Holds the values stored by the node, a new MemoryStore if nil
+}
+
+// DefaultConfig returns the Config with the default value of every parameter
+func DefaultConfig() Config {
+	config, _ := Config{}.validate()
+	return config
+}
+
+// validate returns the Config with the defaults in place of its zero parameters,
+// or an error wrapping ErrInvalidConfig if any parameter is out of range
+func (config Config) validate() (Config, error) {
+	setDefault := func(value *int, def int) {
+		if *value == 0 {
+			*value = def
+		}
+	}
+	setDefaultDuration := func(value *time.Duration, def time.Duration) {
+		if *value == 0 {
+			*value = def
+		}
+	}
+	setDefault(&config.Alpha, concurrencyParam)
+	setDefault(&config.K, replicationParam)
+	setDefault(&config.BucketSize, bucketSize)
+	setDefault(&config.BufferSize, bufferSize)
+	if max := config.BufferSize - storeOverhead; max < chunkSize { // Fit the default in smaller buffers
+		setDefault(&config.ChunkSize, max)
+	}
+	setDefault(&config.ChunkSize, chunkSize)
+	setDefaultDuration(&config.RepublishDelay, republishDelayHr*time.Hour)
+	setDefaultDuration(&config.ExpirationDelay, expirationDelayHr*time.Hour)
+	setDefaultDuration(&config.RefreshInterval, refreshIntervalHr*time.Hour)
+	setDefaultDuration(&config.ReplicateInterval, replicateIntervalHr*time.Hour)
+	setDefaultDuration(&config.PingTimeout, pingTimeoutSec*time.Second)
+	setDefaultDuration(&config.FindTimeout, findTimeoutSec*time.Second)
+	setDefaultDuration(&config.StoreTimeout, storeTimeoutSec*time.Second)
+	setDefaultDuration(&config.StallTimeout, stallTimeoutMs*time.Millisecond)
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
+
+	for _, param := range []struct {
+		name  string
+		value int64
+	}{
+		{"Alpha", int64(config.Alpha)},
+		{"K", int64(config.K)},
+		{"BucketSize", int64(config.BucketSize)},
+		{"BufferSize", int64(config.BufferSize)},
+		{"ChunkSize", int64(config.ChunkSize)},
+		{"RepublishDelay", int64(config.RepublishDelay)},
+		{"ExpirationDelay", int64(config.ExpirationDelay)},
+		{"RefreshInterval", int64(config.RefreshInterval)},
+		{"ReplicateInterval", int64(config.ReplicateInterval)},
+		{"PingTimeout", int64(config.PingTimeout)},
+		{"FindTimeout", int64(config.FindTimeout)},
+		{"StoreTimeout", int64(config.StoreTimeout)},
+		{"StallTimeout", int64(config.StallTimeout)},
+		{"RelaxedDepth", int64(config.RelaxedDepth)},
+		{"Diversity.BucketIP", int64(config.Diversity.BucketIP)},
+		{"Diversity.BucketSubnet", int64(config.Diversity.BucketSubnet)},
+		{"Diversity.TableIP", int64(config.Diversity.TableIP)},
+		{"Diversity.TableSubnet", int64(config.Diversity.TableSubnet)},
+	} {
+		if param.value < 0 {
+			return config, fmt.Errorf("%w: %s is negative", ErrInvalidConfig, param.name)
+		}
+	}
+	if config.RelaxedDepth > 0 && !config.TreeRoutes {
+		return config, fmt.Errorf("%w: RelaxedDepth requires TreeRoutes", ErrInvalidConfig)
+	}
+	if min := headerSize + config.K*maxContactSize; config.BufferSize < min { // A response carries up to K contacts
+		return config, fmt.Errorf("%w: BufferSize must be at least %d for K %d", ErrInvalidConfig, min, config.K)
+	}
+	if max := config.BufferSize - storeOverhead; config.ChunkSize > max { // A STORE carries a chunk
+		return config, fmt.Errorf("%w: ChunkSize must be at most %d for BufferSize %d", ErrInvalidConfig, max, config.BufferSize)
+	}
+	if min := manifestHeaderSize + 2*IDLength; config.ChunkSize < min { // A manifest lists at least two parts
+		return config, fmt.Errorf("%w: ChunkSize must be at least %d", ErrInvalidConfig, min)
+	}
+	return config, nil
+}
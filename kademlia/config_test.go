@@ -0,0 +1,103 @@
+package kademlia
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	config := DefaultConfig()
+	if config.Alpha != concurrencyParam || config.K != replicationParam || config.BucketSize != bucketSize {
+		t.Errorf("DefaultConfig failed: alpha %d, k %d, bucket size %d", config.Alpha, config.K, config.BucketSize)
+	}
+	if config.ExpirationDelay != expirationDelayHr*time.Hour || config.FindTimeout != findTimeoutSec*time.Second {
+		t.Errorf("DefaultConfig failed: expiration %v, find timeout %v", config.ExpirationDelay, config.FindTimeout)
+	}
+	// The parameters set are kept, the others take their default
+	node, err := NewKademlia(NewContact(NewRandomKademliaID(), localAddr), Config{K: 5, PingTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewKademlia failed: %v", err)
+	}
+	if node.config.K != 5 || node.Net.config.PingTimeout != time.Second || node.config.Alpha != concurrencyParam {
+		t.Errorf("NewKademlia failed: config %+v", node.config)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	invalid := map[string]Config{
+		"negative alpha":         {Alpha: -1},
+		"negative timeout":       {FindTimeout: -time.Second},
+		"negative limit":         {Diversity: DiversityLimits{TableSubnet: -1}},
+		"relaxed fixed layout":   {RelaxedDepth: 2},
+		"buffer too small":       {BufferSize: 512},
+		"buffer too small for k": {K: 200},
+		"chunk too large":        {ChunkSize: bufferSize},
+		"chunk too small":        {ChunkSize: 64},
+	}
+	for name, config := range invalid {
+		if _, err := NewKademlia(NewContact(NewRandomKademliaID(), localAddr), config); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: NewKademlia returned %v instead of ErrInvalidConfig", name, err)
+		}
+	}
+	if _, err := NewKademlia(NewContact(NewRandomKademliaID(), localAddr), Config{TreeRoutes: true, RelaxedDepth: 2}); err != nil {
+		t.Errorf("NewKademlia failed: %v", err)
+	}
+	// The default chunk size shrinks to fit a smaller buffer
+	node, err := NewKademlia(NewContact(NewRandomKademliaID(), localAddr), Config{BufferSize: 2048})
+	if err != nil {
+		t.Fatalf("NewKademlia failed: %v", err)
+	}
+	if node.config.ChunkSize != 2048-storeOverhead {
+		t.Errorf("NewKademlia failed: chunk size %d for a buffer of 2048", node.config.ChunkSize)
+	}
+}
+
+func TestConfigExpirationDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	node := newTestNodeConfig(t, NewMemoryNetwork(), NewRandomKademliaID(), listenPort, Config{ExpirationDelay: delay})
+	node.handleRPC(storeRequest, [][]byte{[]byte(objContent)})
+	if _, _, err := node.config.Store.Get(objHash); err != nil {
+		t.Fatal("STORE RPC failed: value not stored")
+	}
+	deadline := time.Now().Add(20 * delay)
+	for time.Now().Before(deadline) {
+		if _, _, err := node.config.Store.Get(objHash); err != nil {
+			return
+		}
+		time.Sleep(delay / 5)
+	}
+	t.Error("ExpirationDelay failed: value not deleted")
+}
+
+func TestExpiredValueNotServed(t *testing.T) {
+	clock := newFakeClock() // Never advanced, the expiring routine does not get to the value
+	node := newTestNodeConfig(t, NewMemoryNetwork(), NewRandomKademliaID(), listenPort, Config{Clock: clock})
+	node.config.Store.Put(objHash, []byte(objContent), clock.Now())
+	if typ, _ := node.handleRPC(findValueRequest, [][]byte{NewKademliaID(objHash)[:]}); typ == valueResponse {
+		t.Error("FIND_VALUE failed: expired value returned")
+	}
+	if _, _, err := node.config.Store.Get(objHash); err == nil {
+		t.Error("FIND_VALUE failed: expired value not deleted")
+	}
+}
+
+func TestConfigK(t *testing.T) {
+	const k = 4
+	mn := NewMemoryNetwork()
+	nodes := make([]*Kademlia, 10)
+	for i := range nodes {
+		nodes[i] = newTestNodeConfig(t, mn, NewRandomKademliaID(), listenPort+i, Config{K: k, Alpha: 1})
+		if i > 0 {
+			if err := nodes[i].Join(nodes[0].Net.RT.me.Address); err != nil {
+				t.Fatalf("Join failed: %v", err)
+			}
+		}
+	}
+	if found := nodes[1].LookupContact(NewRandomKademliaID()); len(found) != k {
+		t.Errorf("LookupContact failed: %d contacts returned instead of %d", len(found), k)
+	}
+	if typ, fields := nodes[1].handleRPC(findNodeRequest, [][]byte{NewRandomKademliaID()[:]}); typ != contactsResponse || len(fields) != k {
+		t.Errorf("FIND_NODE RPC failed: %d contacts returned instead of %d", len(fields), k)
+	}
+}
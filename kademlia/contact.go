@@ -3,19 +3,25 @@ package kademlia
 import (
 	"fmt"
 	"sort"
+	"time"
 )
 
 // Contact definition
-// stores the KademliaID, the ip address and the distance
+// stores the KademliaID, the UDP endpoint ("ip:port") and the distance, together
+// with the liveness metadata kept by the routing table
 type Contact struct {
-	ID       *KademliaID
-	Address  string
-	distance *KademliaID
+	ID          *KademliaID `json:"id"`
+	Address     string      `json:"address"`
+	distance    *KademliaID
+	LastSeen    time.Time     `json:"last_seen"`    // Last time a message was received from the contact
+	LastReplied time.Time     `json:"last_replied"` // Last time the contact answered an RPC
+	RTT         time.Duration `json:"rtt_ns"`       // Smoothed round-trip time of its RPCs, zero if unknown
+	Failures    int           `json:"failures"`     // RPCs it failed to answer since it was last seen
 }
 
 // NewContact returns a new instance of a Contact
 func NewContact(id *KademliaID, address string) Contact {
-	return Contact{id, address, nil}
+	return Contact{ID: id, Address: address}
 }
 
 // CalcDistance calculates the distance to the target and
@@ -24,11 +30,22 @@ func (contact *Contact) CalcDistance(target *KademliaID) {
 	contact.distance = contact.ID.CalcDistance(target)
 }
 
-// Less returns true if contact.distance < otherContact.distance
+// Less returns true if contact.distance < otherContact.distance. When the distances
+// tie, that is for the same node at different addresses, the contact with the lower
+// round-trip time goes first, and the ones whose round-trip time is unknown go last
 func (contact *Contact) Less(otherContact *Contact) bool {
+	if contact.distance.Equals(otherContact.distance) {
+		return contact.RTT != 0 && (otherContact.RTT == 0 || contact.RTT < otherContact.RTT)
+	}
 	return contact.distance.Less(otherContact.distance)
 }
 
+// dead returns true if the contact failed to answer enough RPCs since it was
+// last seen to be considered unreachable
+func (contact *Contact) dead() bool {
+	return contact.Failures >= deadContactFailures
+}
+
 // String returns a simple string representation of a Contact
 func (contact *Contact) String() string {
 	return fmt.Sprintf(`contact("%s", "%s")`, contact.ID, contact.Address)
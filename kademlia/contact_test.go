@@ -0,0 +1,31 @@
+package kademlia
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContactLessPrefersLowLatency(t *testing.T) {
+	target := NewRandomKademliaID()
+	id := NewRandomKademliaID()
+	slow, fast, unknown := NewContact(id, "10.0.0.1:1"), NewContact(id, "10.0.0.2:1"), NewContact(id, "10.0.0.3:1")
+	slow.RTT, fast.RTT = 200*time.Millisecond, 20*time.Millisecond
+	slow.CalcDistance(target)
+	fast.CalcDistance(target)
+	unknown.CalcDistance(target)
+	var candidates ContactCandidates
+	candidates.Append([]Contact{unknown, slow, fast})
+	// The same node at three addresses: the fastest first, the unknown last
+	candidates.Sort()
+	for i, addr := range []string{fast.Address, slow.Address, unknown.Address} {
+		if got := candidates.GetContacts(3)[i].Address; got != addr {
+			t.Errorf("Sort failed: contact %d is %s, expected %s", i, got, addr)
+		}
+	}
+	// Closer contacts always go first, whatever their latency
+	closer := NewContact(target, "10.0.0.4:1")
+	closer.CalcDistance(target)
+	if !closer.Less(&fast) || fast.Less(&closer) {
+		t.Error("Less failed: latency preferred to distance")
+	}
+}
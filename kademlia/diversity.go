@@ -0,0 +1,115 @@
+package kademlia
+
+import (
+	"container/list"
+	"net"
+)
+
+const subnetBitsIPv4 = 24 // Leading bits of the IPv4 addresses grouped in the same subnet
+const subnetBitsIPv6 = 64 // Leading bits of the IPv6 addresses grouped in the same subnet
+
+// DiversityLimits definition
+// bounds the number of contacts sharing an IP address, or a subnet, that can sit in one
+// Bucket and in the whole RoutingTable, so that a single host or subnet cannot fill them.
+// A limit of 0 disables it
+type DiversityLimits struct {
+	BucketIP     int // Contacts per IP address in a Bucket
+	BucketSubnet int // Contacts per subnet in a Bucket
+	TableIP      int // Contacts per IP address in the RoutingTable
+	TableSubnet  int // Contacts per subnet in the RoutingTable
+}
+
+// DiversityRejections definition
+// counts the contacts rejected by the RoutingTable for exceeding each of its DiversityLimits
+type DiversityRejections struct {
+	BucketIP     int `json:"bucket_ip"`
+	BucketSubnet int `json:"bucket_subnet"`
+	TableIP      int `json:"table_ip"`
+	TableSubnet  int `json:"table_subnet"`
+}
+
+// host definition
+// identifies the IP address of a contact and the subnet it belongs to
+type host struct {
+	ip     string
+	subnet string
+}
+
+// hostOf returns the host of the address specified, and false if it has no IP address
+func hostOf(address string) (host, bool) {
+	ip, _, err := splitAddr(address)
+	if err != nil || ip == nil {
+		return host{}, false
+	}
+	mask := net.CIDRMask(subnetBitsIPv6, 8*net.IPv6len)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, net.CIDRMask(subnetBitsIPv4, 8*net.IPv4len)
+	}
+	return host{ip: ip.String(), subnet: ip.Mask(mask).String()}, true
+}
+
+// countHosts returns the number of Contacts in l sharing the IP address and the subnet of h
+func countHosts(l *list.List, h host) (ips int, subnets int) {
+	for e := l.Front(); e != nil; e = e.Next() {
+		other, ok := hostOf(e.Value.(Contact).Address)
+		if !ok || other.subnet != h.subnet {
+			continue
+		}
+		subnets++
+		if other.ip == h.ip {
+			ips++
+		}
+	}
+	return ips, subnets
+}
+
+// admit returns true if the new contact fits the DiversityLimits of the RoutingTable once
+// added to the Bucket specified, counting the rejection otherwise. Contacts without an IP
+// address are always admitted
+func (routingTable *RoutingTable) admit(bucket *bucket, contact Contact) bool {
+	limits := routingTable.limits
+	h, ok := hostOf(contact.Address)
+	if !ok || limits == (DiversityLimits{}) {
+		return true
+	}
+	ips, subnets := countHosts(bucket.list, h)
+	switch {
+	case limits.BucketIP > 0 && ips >= limits.BucketIP:
+		routingTable.rejected.BucketIP++
+		return false
+	case limits.BucketSubnet > 0 && subnets >= limits.BucketSubnet:
+		routingTable.rejected.BucketSubnet++
+		return false
+	}
+	if limits.TableIP == 0 && limits.TableSubnet == 0 {
+		return true
+	}
+	ips, subnets = 0, 0
+	for _, b := range routingTable.buckets {
+		i, s := countHosts(b.list, h)
+		ips, subnets = ips+i, subnets+s
+	}
+	switch {
+	case limits.TableIP > 0 && ips >= limits.TableIP:
+		routingTable.rejected.TableIP++
+		return false
+	case limits.TableSubnet > 0 && subnets >= limits.TableSubnet:
+		routingTable.rejected.TableSubnet++
+		return false
+	}
+	return true
+}
+
+// SetDiversityLimits sets the limits applied to the contacts added from now on
+func (routingTable *RoutingTable) SetDiversityLimits(limits DiversityLimits) {
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+	routingTable.limits = limits
+}
+
+// Rejected returns the number of contacts rejected so far for exceeding each limit
+func (routingTable *RoutingTable) Rejected() DiversityRejections {
+	routingTable.mu.RLock()
+	defer routingTable.mu.RUnlock()
+	return routingTable.rejected
+}
@@ -0,0 +1,153 @@
+package kademlia
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHostOf(t *testing.T) {
+	tests := []struct {
+		a, b       string
+		ip, subnet bool // Whether a and b share their IP address and their subnet
+	}{
+		{"10.0.0.1:1", "10.0.0.1:2", true, true},
+		{"10.0.0.1:1", "10.0.0.200:1", false, true},
+		{"10.0.0.1:1", "10.0.1.1:1", false, false},
+		{"[2001:db8::1]:1", "[2001:db8::1:0:0:2]:1", false, true},
+		{"[2001:db8::1]:1", "[2001:db8:0:1::1]:1", false, false},
+		{"10.0.0.1:1", "[::ffff:10.0.0.1]:1", true, true},
+	}
+	for _, test := range tests {
+		a, okA := hostOf(test.a)
+		b, okB := hostOf(test.b)
+		if !okA || !okB {
+			t.Fatalf("hostOf failed: %s or %s has no host", test.a, test.b)
+		}
+		if (a.ip == b.ip) != test.ip || (a.subnet == b.subnet) != test.subnet {
+			t.Errorf("hostOf failed: %s and %s give %v and %v", test.a, test.b, a, b)
+		}
+	}
+	if _, ok := hostOf("localhost:8000"); ok {
+		t.Error("hostOf failed: a host name has no IP address")
+	}
+}
+
+func TestDiversityLimitsBucket(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewKademliaID(nullID), "10.0.1.1:8000"))
+	rt.SetDiversityLimits(DiversityLimits{BucketIP: 2, BucketSubnet: 4})
+	// An attacker floods the bucket 0 from a single subnet
+	for i := 0; i < bucketSize; i++ {
+		rt.AddContact(NewContact(idInFirstBucket(byte(i)), fmt.Sprintf("10.6.6.%d:8000", i%3)))
+	}
+	if n := len(rt.bucketContacts(0)); n != 4 {
+		t.Errorf("AddContact failed: %d contacts of the subnet in the bucket, expected 4", n)
+	}
+	perIP := make(map[string]int)
+	for _, c := range rt.bucketContacts(0) {
+		if perIP[c.Address]++; perIP[c.Address] > 2 {
+			t.Errorf("AddContact failed: contacts of %s admitted over the IP limit", c.Address)
+		}
+	}
+	rejected := rt.Rejected()
+	if rejected.BucketIP != 5 || rejected.BucketSubnet != bucketSize-4-5 {
+		t.Errorf("Rejected failed: %+v", rejected)
+	}
+	// The rejected contacts do not wait in the replacement cache either
+	if n := len(rt.Buckets()[0].Replacements); n != 0 {
+		t.Errorf("AddContact failed: %d rejected contacts cached", n)
+	}
+	// Other subnets fill the rest of the bucket
+	for i := 0; i < bucketSize; i++ {
+		rt.AddContact(NewContact(idInFirstBucket(byte(100+i)), fmt.Sprintf("10.0.%d.1:8000", i)))
+	}
+	if n := len(rt.bucketContacts(0)); n != bucketSize {
+		t.Errorf("AddContact failed: %d contacts in the bucket, expected %d", n, bucketSize)
+	}
+	// Contacts already in the bucket are still refreshed
+	rt.AddContact(NewContact(idInFirstBucket(0), "10.6.6.0:8000"))
+	if !rt.bucketContacts(0)[0].ID.Equals(idInFirstBucket(0)) {
+		t.Error("AddContact failed: contact of the subnet not refreshed")
+	}
+}
+
+func TestDiversityLimitsTable(t *testing.T) {
+	me := NewContact(NewRandomKademliaID(), "10.0.1.1:8000")
+	for name, rt := range map[string]*RoutingTable{"fixed": NewRoutingTable(me), "tree": NewTreeRoutingTable(me, 1)} {
+		rt.SetDiversityLimits(DiversityLimits{TableIP: 3, TableSubnet: 10})
+		// An attacker floods the whole table from a single subnet, with IDs close to me
+		const flood = 200
+		for i := 0; i < flood; i++ {
+			rt.AddContact(NewContact(neighborID(me.ID, 100+i%60), fmt.Sprintf("10.6.6.%d:8000", i%50)))
+		}
+		const honest = 60 // One per bucket
+		for i := 0; i < honest; i++ {
+			rt.AddContact(NewContact(neighborID(me.ID, i), fmt.Sprintf("10.0.%d.%d:8000", i%10, i)))
+		}
+		attackers := func(contacts []Contact) int {
+			n := 0
+			for _, c := range contacts {
+				if h, _ := hostOf(c.Address); h.subnet == "10.6.6.0" {
+					n++
+				}
+			}
+			return n
+		}
+		if n := attackers(rt.Contacts()); n != 10 {
+			t.Errorf("%s: %d contacts of the subnet in the table, expected 10", name, n)
+		}
+		if n := attackers(rt.FindClosestContacts(me.ID, bucketSize)); n > 10 {
+			t.Errorf("%s: %d contacts of the subnet closest to me", name, n)
+		}
+		if rejected := rt.Rejected(); rejected.TableSubnet != flood-10 {
+			t.Errorf("%s: Rejected failed: %+v", name, rejected)
+		}
+		// The honest contacts are kept
+		if n := len(rt.Contacts()) - 10; n != honest {
+			t.Errorf("%s: %d honest contacts in the table, expected %d", name, n, honest)
+		}
+	}
+}
+
+func TestDiversityLimitsReplacements(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewKademliaID(nullID), "10.0.1.1:8000"))
+	rt.SetDiversityLimits(DiversityLimits{BucketIP: 2})
+	for i := 0; i < bucketSize; i++ {
+		rt.AddContact(NewContact(idInFirstBucket(byte(i)), fmt.Sprintf("10.0.%d.1:8000", i)))
+	}
+	// An attacker floods the replacement cache of the full bucket from a single IP address,
+	// which is admitted there since none of its contacts is in the bucket yet
+	const flood = 5
+	for i := 0; i < flood; i++ {
+		rt.AddContact(NewContact(idInFirstBucket(byte(100+i)), "66.6.6.6:8000"))
+	}
+	honest := NewContact(idInFirstBucket(200), "10.1.0.1:8000")
+	rt.AddContact(honest)
+	// Every eviction promotes a replacement, checked against the limits again
+	for i := 0; i < flood+1; i++ {
+		switch id := idInFirstBucket(byte(i)); i % 3 {
+		case 0:
+			rt.RemoveContact(id)
+		case 1:
+			for !rt.FailContact(NewContact(id, fmt.Sprintf("10.0.%d.1:8000", i))) {
+			}
+		case 2:
+			rt.PenalizeContact(NewContact(id, fmt.Sprintf("10.0.%d.1:8000", i)), time.Now())
+		}
+	}
+	attackers := 0
+	for _, c := range rt.bucketContacts(0) {
+		if c.Address == "66.6.6.6:8000" {
+			attackers++
+		}
+	}
+	if attackers != 2 {
+		t.Errorf("RemoveContact failed: %d contacts of the IP address promoted, expected 2", attackers)
+	}
+	if !rt.hasContact(honest.ID) {
+		t.Error("RemoveContact failed: the honest replacement was not promoted")
+	}
+	if n := len(rt.Buckets()[0].Replacements); n != flood-2 {
+		t.Errorf("RemoveContact failed: %d contacts left in the cache, expected %d", n, flood-2)
+	}
+}
@@ -0,0 +1,66 @@
+package kademlia
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned when a value cannot be found in the network or in a Store
+var ErrNotFound = errors.New("kademlia: value not found")
+
+// ErrTimeout is returned when a contact does not respond to an RPC in time
+var ErrTimeout = errors.New("kademlia: RPC timed out")
+
+// ErrClosed is returned by the operations interrupted by the closing of the node
+var ErrClosed = errors.New("kademlia: node closed")
+
+// ErrTooManyRPCs is returned when an RPC cannot be sent because too many are waiting for a response
+var ErrTooManyRPCs = errors.New("kademlia: too many RPCs in flight")
+
+// ErrNoReplicas is returned when no node, not even this one, stored a value
+var ErrNoReplicas = errors.New("kademlia: no node stored the value")
+
+// ErrNoContacts is returned when none of the known contacts responds
+var ErrNoContacts = errors.New("kademlia: no known contact responded")
+
+// ErrForgedValue is returned when a value does not match the key it is stored under
+var ErrForgedValue = errors.New("kademlia: value does not match its key")
+
+// ErrInvalidConfig is returned when a parameter of a Config is out of range
+var ErrInvalidConfig = errors.New("kademlia: invalid config")
+
+// RPCError definition
+// reports the failure of an RPC sent to a contact
+type RPCError struct {
+	RPC     string
+	Contact Contact
+	Err     error
+}
+
+// Error returns a description of the failed RPC
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("kademlia: %s RPC to %s: %v", e.RPC, e.Contact.Address, e.Err)
+}
+
+// Unwrap returns the cause of the failure
+func (e *RPCError) Unwrap() error {
+	return e.Err
+}
+
+// NotFoundError definition
+// reports a value lookup that did not find the value, together with the
+// k-closest contacts to its hash
+type NotFoundError struct {
+	Hash    string
+	Closest []Contact
+}
+
+// Error returns a description of the failed lookup
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("kademlia: value %s not found", e.Hash)
+}
+
+// Is makes errors.Is(err, ErrNotFound) hold for every NotFoundError
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
@@ -0,0 +1,218 @@
+package kademlia
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fileStoreExt = ".value"     // Extension of the files holding the values
+const fileStoreHeaderSize = 8     // Expiration time, in nanoseconds since the Unix epoch, 0 if none
+const fileStoreDirMode = 0700     // Permissions of the directory of a FileStore
+const fileStoreTmpPrefix = ".tmp" // Prefix of the files being written
+
+var errCorruptValue = errors.New("value file too short")
+var errInvalidKey = errors.New("key not in lowercase hexadecimal")
+
+// FileStore definition
+// implements the Store interface with a directory holding one file per value,
+// named after its key, so that the values survive a restart of the node. The keys
+// must be in lowercase hexadecimal, as the ones of the values of the network.
+// Each file starts with the expiration time of its value
+type FileStore struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+// NewFileStore returns a new instance of a FileStore keeping its values in the directory
+// specified, which is created if needed. The values already in it are kept
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, fileStoreDirMode); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Put stores the value under the key, replacing its file atomically
+func (s *FileStore) Put(key string, value []byte, expires time.Time) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp, err := ioutil.TempFile(s.dir, fileStoreTmpPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Only left behind if something failed
+	data := append(encodeExpiration(expires), value...)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get returns the value stored under the key and its expiration time
+func (s *FileStore) Get(key string) ([]byte, time.Time, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.read(path)
+}
+
+// Touch rewrites the expiration time at the start of the file of the value
+func (s *FileStore) Touch(key string, expires time.Time) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(encodeExpiration(expires), 0); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Delete removes the file of the value stored under the key, if any
+func (s *FileStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Range calls f for every value stored until f returns false
+func (s *FileStore) Range(f func(key string, value []byte, expires time.Time) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.scan(func(key string, path string) (bool, error) {
+		value, expires, err := s.read(path)
+		if err != nil {
+			return false, err
+		}
+		return f(key, value, expires), nil
+	})
+}
+
+// Expire removes the file of every value expired at now
+func (s *FileStore) Expire(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scan(func(key string, path string) (bool, error) {
+		_, expires, err := s.read(path)
+		if err == nil && expired(expires, now) {
+			err = os.Remove(path)
+		}
+		return err == nil, err
+	})
+}
+
+// Close does nothing, every value is already in its file
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// path returns the path of the file of the value stored under the key,
+// or an error if the key cannot name a file
+func (s *FileStore) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", fmt.Errorf("%q: %w", key, errInvalidKey)
+	}
+	return filepath.Join(s.dir, key+fileStoreExt), nil
+}
+
+// validKey returns true if the key is in lowercase hexadecimal, so that it can be
+// used as it is as the name of a file on any file system
+func validKey(key string) bool {
+	if key == "" || len(key)%2 != 0 || strings.ToLower(key) != key {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// read returns the value in the file at path and its expiration time
+func (s *FileStore) read(path string) ([]byte, time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(data) < fileStoreHeaderSize {
+		return nil, time.Time{}, fmt.Errorf("%s: %w", path, errCorruptValue)
+	}
+	return data[fileStoreHeaderSize:], decodeExpiration(data), nil
+}
+
+// scan calls f for the key and the path of every file of a value in the directory,
+// until f returns false or an error
+func (s *FileStore) scan(f func(key string, path string) (bool, error)) error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, fileStoreExt) {
+			continue // Not a value, or one still being written
+		}
+		key := strings.TrimSuffix(name, fileStoreExt)
+		if !validKey(key) {
+			continue
+		}
+		if ok, err := f(key, filepath.Join(s.dir, name)); !ok || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeExpiration returns the header of a file holding a value with the expiration time specified
+func encodeExpiration(expires time.Time) []byte {
+	header := make([]byte, fileStoreHeaderSize)
+	if !expires.IsZero() {
+		binary.BigEndian.PutUint64(header, uint64(expires.UnixNano()))
+	}
+	return header
+}
+
+// decodeExpiration returns the expiration time in the header of a file holding a value
+func decodeExpiration(header []byte) time.Time {
+	nanos := int64(binary.BigEndian.Uint64(header))
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
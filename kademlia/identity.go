@@ -0,0 +1,78 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const privateKeyPEMType = "PRIVATE KEY"
+
+// LoadIdentity returns the KademliaID stored in hexadecimal form in the file
+// at path. If the file does not exist, a random ID is generated and saved there
+func LoadIdentity(path string) (*KademliaID, error) {
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { // First start, create a new identity
+		id := NewRandomKademliaID()
+		if err := ioutil.WriteFile(path, []byte(id.String()+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseKademliaID(strings.TrimSpace(string(data)))
+}
+
+// LoadKeyPairIdentity returns the KademliaID derived from the ed25519 key pair
+// stored in PEM form in the file at path, together with its private key.
+// If the file does not exist, a new key pair is generated and saved there
+func LoadKeyPairIdentity(path string) (*KademliaID, ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { // First start, create a new key pair
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		block := pem.EncodeToMemory(&pem.Block{Type: privateKeyPEMType, Bytes: der})
+		if err := ioutil.WriteFile(path, block, 0600); err != nil {
+			return nil, nil, err
+		}
+		return IDFromPublicKey(priv.Public().(ed25519.PublicKey)), priv, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != privateKeyPEMType {
+		return nil, nil, fmt.Errorf("%s: no %s block found", path, privateKeyPEMType)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: not an ed25519 private key", path)
+	}
+	return IDFromPublicKey(priv.Public().(ed25519.PublicKey)), priv, nil
+}
+
+// IDFromPublicKey returns the KademliaID associated with the public key,
+// that is the SHA1 hash of the key
+func IDFromPublicKey(pub ed25519.PublicKey) *KademliaID {
+	id := KademliaID(sha1.Sum(pub))
+	return &id
+}
@@ -0,0 +1,42 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "id")
+	// First load should create a new identity
+	id, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatalf("LoadIdentity failed: %v", err)
+	}
+	// Second load should return the same identity
+	if again, err := LoadIdentity(path); err != nil || !again.Equals(id) {
+		t.Error("LoadIdentity failed: identity not persisted")
+	}
+	// Corrupted files should be reported
+	ioutil.WriteFile(path, []byte("not an id"), 0600)
+	if _, err := LoadIdentity(path); err == nil {
+		t.Error("LoadIdentity failed: invalid identity accepted")
+	}
+}
+
+func TestLoadKeyPairIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	id, priv, err := LoadKeyPairIdentity(path)
+	if err != nil {
+		t.Fatalf("LoadKeyPairIdentity failed: %v", err)
+	}
+	// The ID must be derived from the public key
+	if !id.Equals(IDFromPublicKey(priv.Public().(ed25519.PublicKey))) {
+		t.Error("LoadKeyPairIdentity failed: ID not derived from the public key")
+	}
+	// Reloading should return the same key pair
+	if again, _, err := LoadKeyPairIdentity(path); err != nil || !again.Equals(id) {
+		t.Error("LoadKeyPairIdentity failed: key pair not persisted")
+	}
+}
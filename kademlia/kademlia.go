@@ -1,133 +1,328 @@
 package kademlia
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"net"
-	"strings"
 	"sync"
 	"time"
 )
 
-const concurrencyParam = 3   // Alpha definition
-const replicationParam = 20  // K definition
-const republishDelayHr = 12  // Delay for the republishing routines
-const expirationDelayHr = 24 // Delay for the expiration routines
-
 type Kademlia struct {
-	hashTable    sync.Map // String map that stores the data
-	refreshTable sync.Map // Channel map for communicating with the refreshing routines
-	forgetTable  sync.Map // Channel map for communicating with the deleting routines
-	Net          Network
+	forgetTable sync.Map      // Channel map for communicating with the republishing routines
+	resume      sync.Once     // Resumes the republishing of the values published before a restart
+	parts       sync.Map      // Keys of the parts listed by each manifest published, forgotten with it
+	stored      sync.Map      // Last time each value held was stored or replicated, see replicateValues
+	expiring    chan struct{} // Wakes expireValues up for a value that may expire before the others
+	Net         Network
+	ctx         context.Context    // Context of the node, cancelled by Close
+	cancel      context.CancelFunc // Cancels the context of the node
+	spawnMu     sync.Mutex         // Serializes the creation of routines with Close
+	routines    sync.WaitGroup     // Background routines of the node
+	config      Config             // Protocol parameters, with the defaults in place
 }
 
 // NewKademlia creates and returns a new Kademlia object based on the
-// information of the contact
-func NewKademlia(me Contact) *Kademlia {
-	return &Kademlia{
-		hashTable:    sync.Map{},
-		refreshTable: sync.Map{},
-		forgetTable:  sync.Map{},
+// information of the contact and the protocol parameters of the config.
+// It returns an error wrapping ErrInvalidConfig if the config is not valid
+func NewKademlia(me Contact, config Config) (*Kademlia, error) {
+	config, err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	rt := newRoutingTable(me, config.BucketSize, config.TreeRoutes, config.RelaxedDepth)
+	rt.limits = config.Diversity
+	if config.Store == nil {
+		config.Store = NewMemoryStore()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	k := &Kademlia{
+		forgetTable: sync.Map{},
 		Net: Network{
-			RPC: sync.Map{},
-			RT:  NewRoutingTable(me),
+			RT:       rt,
+			pending:  newRPCTracker(maxPendingRPCs),
+			newRPCID: NewRandomKademliaID,
+			closed:   make(chan struct{}),
 		},
+		expiring: make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+		config:   config,
+	}
+	k.Net.config = &k.config
+	return k, nil
+}
+
+// StartListen binds a UDP transport to the ip and port specified and
+// calls for the network layer to start listening on it
+func (k *Kademlia) StartListen(ip string, port int) error {
+	t, err := ListenUDP(ip, port)
+	if err != nil {
+		return err
 	}
+	return k.StartTransport(t)
 }
 
-// StartListen associates the ip and port specified to the listen parameters
-// of the Network and  calls for the network layer to start listening
-func (k *Kademlia) StartListen(ip string, port int) {
-	k.Net.ListenIP = net.ParseIP(ip)
+// StartTransport associates the transport to the Network, fills its listen
+// parameters, calls for the network layer to start listening and starts
+// refreshing the buckets and replicating the values
+func (k *Kademlia) StartTransport(t Transport) error {
+	ip, port, err := splitAddr(t.LocalAddr())
+	if err != nil {
+		return err
+	}
+	k.Net.Transport = t
+	k.Net.ListenIP = ip
 	k.Net.ListenPort = port
-	go k.Net.listen(k)
+	k.spawn(func() { k.Net.listen(k) })
+	k.spawn(k.refreshBuckets)
+	k.spawn(k.expireValues)
+	k.spawn(k.replicateValues)
+	return nil
 }
 
-// ForgetData stops the updating routine of the refresher node. Returns true if the node holds
-// the data and false otherwise
+// Close stops the node: the listener and every refreshing, deleting and republishing
+// routine are terminated, and the pending RPCs fail with ErrClosed. Values held by the
+// node are lost, use Shutdown to hand them off first. Close is safe to call more than once
+func (k *Kademlia) Close() error {
+	k.spawnMu.Lock()
+	k.cancel() // No new routine can be started from now on
+	k.spawnMu.Unlock()
+	err := k.Net.Close()
+	k.routines.Wait()
+	if storeErr := k.config.Store.Close(); err == nil {
+		err = storeErr
+	}
+	return err
+}
+
+// Shutdown hands off every value held by the node to the next-closest nodes
+// of the routing table and then closes the node. If the context is done before
+// the hand-off completes, the node is closed anyway and the context error returned
+func (k *Kademlia) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	now := k.config.Clock.Now()
+	k.config.Store.Range(func(hash string, value []byte, expires time.Time) bool { // For each value stored
+		if expired(expires, now) { // Nothing left to hand off
+			return true
+		}
+		for _, c := range k.Net.RT.FindClosestContacts(NewKademliaID(hash), k.config.K) {
+			wg.Add(1)
+			go func(c Contact) { // Send the STORE RPC to the contact with the data and the time it has left
+				defer wg.Done()
+				k.Net.SendStoreMessageContext(ctx, value, timeToLive(expires, now), &c)
+			}(c)
+		}
+		return ctx.Err() == nil // Stop if the caller is no longer interested
+	})
+	wg.Wait()
+	if err := k.Close(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// spawn runs f in a background routine waited for by Close. If the node
+// is already closed, f is not run
+func (k *Kademlia) spawn(f func()) {
+	k.spawnMu.Lock()
+	defer k.spawnMu.Unlock()
+	if k.ctx.Err() != nil {
+		return
+	}
+	k.routines.Add(1)
+	go func() {
+		defer k.routines.Done()
+		f()
+	}()
+}
+
+// notify sends a notification through the channel to the routine listening
+// on it, unless the node is closed
+func (k *Kademlia) notify(ch interface{}) {
+	select {
+	case ch.(chan interface{}) <- nil:
+	case <-k.ctx.Done():
+	}
+}
+
+// Join adds the node listening on the address specified to the routing table and
+// initiates a lookup for our own ID
+func (k *Kademlia) Join(address string) error {
+	return k.JoinContext(context.Background(), address)
+}
+
+// JoinContext is like Join but stops as soon as the context is done. The ID of
+// the bootstrap node does not need to be known in advance, since it is declared
+// in its response to our PING
+func (k *Kademlia) JoinContext(ctx context.Context, address string) error {
+	bn := NewContact(NewRandomKademliaID(), address) // Placeholder until the node declares its ID
+	resp, err := k.Net.call(ctx, &bn, pingRequest)
+	if err != nil {
+		return err
+	}
+	id := resp.SenderID
+	k.Net.RT.AddContact(NewContact(&id, address))        // Add the BN to the routing table
+	_, err = k.LookupContactContext(ctx, k.Net.RT.me.ID) // Initiate a lookup
+	return err
+}
+
+// Rejoin pings every contact of the routing table, typically reloaded with Load after
+// a restart, removes the ones that do not respond and initiates a lookup for our own
+// ID through the others. It returns ErrNoContacts if none of them responds
+func (k *Kademlia) Rejoin() error {
+	return k.RejoinContext(context.Background())
+}
+
+// RejoinContext is like Rejoin but stops as soon as the context is done
+func (k *Kademlia) RejoinContext(ctx context.Context) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	alive := 0
+	for _, c := range k.Net.RT.Contacts() {
+		wg.Add(1)
+		go func(c Contact) { // Ping the contacts in parallel
+			defer wg.Done()
+			resp, err := k.Net.call(ctx, &c, pingRequest)
+			switch {
+			case err == nil && resp.SenderID.Equals(c.ID):
+				mu.Lock()
+				alive++
+				mu.Unlock()
+			case ctx.Err() == nil && !errors.Is(err, ErrClosed): // Gone, or restarted with another ID
+				k.Net.RT.RemoveContact(c.ID)
+			}
+		}(c)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if alive == 0 {
+		return ErrNoContacts
+	}
+	_, err := k.LookupContactContext(ctx, k.Net.RT.me.ID) // Initiate a lookup
+	return err
+}
+
+// ForgetData stops the updating routine of the refresher node, and the ones of the chunks
+// if the data is a large object. Returns true if the node holds the data and false otherwise
 func (k *Kademlia) ForgetData(hash string) bool {
 	if ch, ok := k.forgetTable.Load(hash); ok { // If the node is the refresher of the data
-		ch.(chan interface{}) <- nil // Stop the updating routine
-		k.forgetTable.Delete(hash)   // Delete the channel
+		k.notify(ch)               // Stop the updating routine
+		k.forgetTable.Delete(hash) // Delete the channel
+		k.unpublish(hash)          // Do not resume it after a restart
+		if parts, ok := k.parts.Load(hash); ok {
+			k.parts.Delete(hash)
+			for _, part := range parts.([]KademliaID) {
+				k.ForgetData(part.String())
+			}
+		}
 		return true
 	}
 	return false
 }
 
 // handleRPC executes the code associated with the handling of the RPC
-// specified in the parameters and returns the generated response
-func (k *Kademlia) handleRPC(cmd string, args []string) string {
+// specified in the parameters and returns the type and the fields of the
+// generated response. A zero response type means that no response is due
+func (k *Kademlia) handleRPC(cmd messageType, args [][]byte) (messageType, [][]byte) {
 	switch cmd {
-	case "PING":
-		return ""
-	case "STORE":
+	case pingRequest:
+		return pingResponse, nil
+	case storeRequest:
+		if len(args) == 0 || len(args) > 2 || (len(args) == 2 && len(args[1]) != ttlSize) {
+			return 0, nil
+		} // Malformed request
 		// Obtain the hash of the data
 		h := sha1.New()
-		h.Write([]byte(args[0]))
+		h.Write(args[0])
 		key := hex.EncodeToString(h.Sum(nil))
-		// If the value is loaded then it is a refresh STORE
-		if ch, ok := k.refreshTable.LoadOrStore(key, make(chan interface{})); ok {
-			ch.(chan interface{}) <- nil // Notify the refreshing routine
-		} else { // If the value is not stored
-			k.hashTable.Store(key, args[0])   // Store the value
-			ch, _ := k.refreshTable.Load(key) // Obtain a channel for the refreshing routine
-			go func() {                       // Create an anonymous parallel function
-				for {
-					select {
-					case <-ch.(chan interface{}): // If it receives a "notification" it restarts the timeout
-					case <-time.After(expirationDelayHr * time.Hour): // If the timeout is completed
-						k.refreshTable.Delete(key) // The channel is deleted
-						k.hashTable.Delete(key)    // The data is deleted
-						return
-					}
-				}
-			}()
+		// A replicated value lives as long as the original publisher said so, replicating it does
+		// not push that back. A STORE without a time to live is a publication, as is one too long
+		now := k.config.Clock.Now()
+		expires := k.expiration()
+		if len(args) == 2 {
+			if ttl := decodeTTL(args[1]); ttl < k.config.ExpirationDelay {
+				expires = now.Add(ttl)
+			}
+		}
+		if _, current, err := k.config.Store.Get(key); err == nil && current.After(expires) {
+			expires = current // Published again since
 		}
-		return ""
-	case "FIND_VALUE":
-		key := args[0]
-		if data, ok := k.hashTable.Load(key); ok { // If the data is present in the hash table
-			ch, _ := k.refreshTable.Load(key) // Obtain the channel associated with that value
-			ch.(chan interface{}) <- nil      // Refresh the timeout
-			return data.(string)              // Return the value
+		if !expires.After(now) { // Nothing to keep
+			return storeResponse, nil
+		}
+		// Store the value, or restart its expiration if it is a refresh STORE
+		if err := k.config.Store.Put(key, args[0], expires); err != nil {
+			fmt.Printf("Unable to store %s: %v\n", key, err)
+			return 0, nil // Not acknowledged, the sender will try other nodes
+		}
+		if len(args) == 2 { // Unlike a publication, it may expire before the values already held
+			select {
+			case k.expiring <- struct{}{}:
+			default: // expireValues is already due to look again
+			}
+		}
+		k.stored.Store(key, now) // No need to replicate it within the hour
+		return storeResponse, nil
+	case findValueRequest:
+		if len(args) != 1 || len(args[0]) != IDLength {
+			return 0, nil
+		} // Malformed request
+		key := hex.EncodeToString(args[0])
+		if data, ok := k.load(key); ok { // If the data is stored
+			return valueResponse, [][]byte{data} // Return the value
 		}
 		fallthrough // If not execute the following case clause
-	case "FIND_NODE":
-		resp := ""
+	case findNodeRequest:
+		if len(args) != 1 || len(args[0]) != IDLength {
+			return 0, nil
+		} // Malformed request
+		target := KademliaID{}
+		copy(target[:], args[0])
+		var resp [][]byte
 		// Look for the k-closest contacts to the hash
-		for _, c := range k.Net.RT.FindClosestContacts(NewKademliaID(args[0]), replicationParam) {
-			resp += fmt.Sprintf("%s,%d,%s ", c.Address, k.Net.ListenPort, c.ID) // Format the information
+		for _, c := range k.Net.RT.FindClosestContacts(&target, k.config.K) {
+			resp = append(resp, encodeContact(c)) // Encode the information
 		}
-		return strings.TrimSpace(resp)
+		return contactsResponse, resp
 	}
-	return ""
+	return 0, nil
 }
 
 // updateStorage checks for each value stored in the hash table if the necessary
 // requirements for data transfer to the new contact are met
 func (k *Kademlia) updateStorage(contact Contact) {
-	k.hashTable.Range(func(hash, value interface{}) bool { // For each element of the hashTable
-		key := NewKademliaID(hash.(string))
+	me := k.Net.RT.me // Private copy, the distance must not be written to the shared contact
+	now := k.config.Clock.Now()
+	k.config.Store.Range(func(hash string, value []byte, expires time.Time) bool { // For each value stored
+		if expired(expires, now) { // Nothing left to transfer
+			return true
+		}
+		key := NewKademliaID(hash)
 		// Calculate the distance of the contact to the key
 		contact.CalcDistance(key)
 		// Calculate my distance to the key
-		k.Net.RT.me.CalcDistance(key)
-		if contact.Less(&k.Net.RT.me) { // If the contact is closer
+		me.CalcDistance(key)
+		if contact.Less(&me) { // If the contact is closer
 			// For each of the k-closest contacts to the key
-			for _, c := range k.Net.RT.FindClosestContacts(key, replicationParam) {
+			for _, c := range k.Net.RT.FindClosestContacts(key, k.config.K) {
 				if c.ID.Equals(contact.ID) {
 					continue
 				} // If it is the same contact, continue to the next
 				// Calculate its distance to the key
 				c.CalcDistance(key)
-				if c.Less(&k.Net.RT.me) { // If its distance is closer to the key than me
+				if c.Less(&me) { // If its distance is closer to the key than me
 					// Only one node sends the STORE message
 					return true // Continue to the next value
 				}
 			}
-			// Send the STORE RPC to the contact with the data
-			k.Net.SendStoreMessage([]byte(value.(string)), &contact)
+			// Send the STORE RPC to the contact with the data and the time it has left
+			k.Net.SendStoreMessage(value, timeToLive(expires, now), &contact)
 		}
 		return true // Continue to the next value
 	})
@@ -135,140 +330,124 @@ func (k *Kademlia) updateStorage(contact Contact) {
 
 // LookupContact returns a list of the k-closest contacts to the target
 func (k *Kademlia) LookupContact(target *KademliaID) []Contact {
-	var closest ContactCandidates
-	queried := make(map[string]bool)
-	// For each contact of the k closest to the target
-	for _, c := range k.Net.RT.FindClosestContacts(target, replicationParam) {
-		c.CalcDistance(target) // Calculate the distance to the target
-		queried[c.Address] = false
-		closest.Append([]Contact{c}) // Add it to the closest list
+	contacts, _ := k.LookupContactContext(context.Background(), target)
+	return contacts
+}
+
+// LookupContactContext is like LookupContact but stops as soon as the context is done,
+// returning the closest contacts found so far together with the context error
+func (k *Kademlia) LookupContactContext(ctx context.Context, target *KademliaID) ([]Contact, error) {
+	return k.iterativeLookup(ctx, target, &findNodeStrategy{target: target})
+}
+
+// LookupData returns the data associated with the hash if it is in the Store
+// or a list of the k-closest contacts to the hash otherwise. If the hash is the
+// key of the manifest of a large object, the object is reassembled
+func (k *Kademlia) LookupData(hash string) (interface{}, bool) {
+	data, err := k.LookupDataContext(context.Background(), hash)
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) {
+		return notFound.Closest, false
 	}
-	for {
-		var ids []KademliaID
-		closest.Sort()                                            // Sort the contacts by their distance
-		for _, c := range closest.GetContacts(replicationParam) { // For each contact of the k-closest
-			if queried[c.Address] {
-				continue
-			} // If it has already been queried, continue to the next
-			ids = append(ids, *k.Net.SendFindContactMessage(target, &c)) // Send a FIND_NODE RPC
-			queried[c.Address] = true
-			if len(ids) == concurrencyParam {
-				break
-			} // If it has reached alpha contacts then finish
-		}
-		if len(ids) == 0 { // If all contacts were queried
-			return closest.GetContacts(replicationParam)
-		}
-		for _, id := range ids { // For each of the alpha contacts with the FIND_NODE RPC
-			ch, _ := k.Net.RPC.Load(id) // Obtain the channel for communicating with the network layer
-			select {
-			case resp := <-ch.(chan []string): // If the node responds
-				for _, t := range resp { // For each string of the message
-					triple := strings.Split(t, ",") // Split it by commas
-					// Create the new contact with the information received from the node
-					contact := NewContact(NewKademliaID(triple[2]), triple[0])
-					contact.CalcDistance(target)
-					if _, ok := queried[contact.Address]; !ok { // If the "new" contact was not queried
-						closest.Append([]Contact{contact}) // Append it to the 'closest' struct
-						// Check whether the contact received is me and if so, consider it queried
-						queried[contact.Address] = contact.ID.Equals(k.Net.RT.me.ID)
-					}
-				}
-			case <-time.After(findTimeoutSec * time.Second): // If the node does not respond continue
-			}
-		}
+	if err != nil {
+		return nil, false
 	}
+	return string(data), true
 }
 
-// LookupData returns the data associated with the hash if it is in the hashTable
-// or a list of the k-closest contacts to the hash otherwise
-func (k *Kademlia) LookupData(hash string) (interface{}, bool) {
-	if data, ok := k.hashTable.Load(hash); ok { // If the data is stored
-		// Obtain the channel associated with the refreshing routine
-		ch, _ := k.refreshTable.Load(hash)
-		ch.(chan interface{}) <- nil // Refresh the data
-		return data.(string), true
+// LookupDataContext returns the data associated with the hash, looking for it in the
+// Store first and in the network then. If the data is not found, the returned error
+// is a *NotFoundError carrying the k-closest contacts to the hash. The values received
+// whose SHA1 is not the hash are discarded, and their senders evicted from the routing
+// table. Large objects are reassembled in memory, see LookupObjectContext for writing
+// them out as they arrive
+func (k *Kademlia) LookupDataContext(ctx context.Context, hash string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := k.LookupObjectContext(ctx, hash, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// findValue returns the value stored under the hash, looking for it in the Store
+// first and in the network then, as LookupDataContext does for the small objects.
+// The value returned always matches the hash
+func (k *Kademlia) findValue(ctx context.Context, hash string) ([]byte, error) {
+	if data, ok := k.load(hash); ok { // If the data is stored
+		return data, nil
 	}
-	target := NewKademliaID(hash)
-	var closest ContactCandidates
-	queried := make(map[string]bool)
-	// For each contact of the k closest to the target
-	for _, c := range k.Net.RT.FindClosestContacts(target, replicationParam) {
-		c.CalcDistance(target) // Calculate the distance to the target
-		queried[c.Address] = false
-		closest.Append([]Contact{c}) // Add it to the closest list
+	target, err := ParseKademliaID(hash)
+	if err != nil {
+		return nil, err
 	}
-	for {
-		var ids []KademliaID
-		closest.Sort()                                            // Sort the contacts by their distance
-		for _, c := range closest.GetContacts(replicationParam) { // For each contact of the k-closest
-			if queried[c.Address] {
-				continue
-			} // If it has already been queried, continue to the next
-			ids = append(ids, *k.Net.SendFindDataMessage(target.String(), &c)) // Send a FIND_VALUE RPC
-			queried[c.Address] = true
-			if len(ids) == concurrencyParam {
-				break
-			} // If it has reached alpha contacts then finish
-		}
-		if len(ids) == 0 { // If all contacts were queried
-			return closest.GetContacts(replicationParam), false
-		}
-		for _, id := range ids { // For each of the alpha contacts with the FIND_VALUE RPC
-			ch, _ := k.Net.RPC.Load(id) // Obtain the channel for communicating with the network layer
-			select {
-			case resp := <-ch.(chan []string): // If the node responds
-				for _, t := range resp { // For each string of the message
-					triple := strings.Split(t, ",") // Split it by commas
-					if len(triple) == 1 {           // If the message contains only one string
-						// We return the data
-						return triple[0], true
-					}
-					// Create the new contact with the information received from the node
-					contact := NewContact(NewKademliaID(triple[2]), triple[0])
-					contact.CalcDistance(target)
-					if _, ok := queried[contact.Address]; !ok { // If the "new" contact was not queried
-						closest.Append([]Contact{contact}) // Append it to the 'closest' struct
-						// Check whether the contact received is me and if so, consider it queried
-						queried[contact.Address] = contact.ID.Equals(k.Net.RT.me.ID)
-					}
-				}
-			case <-time.After(findTimeoutSec * time.Second): // If the node does not respond continue
-			}
-		}
+	strategy := &findValueStrategy{target: target}
+	closest, err := k.iterativeLookup(ctx, target, strategy)
+	if strategy.found {
+		return strategy.value, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+	return nil, &NotFoundError{Hash: hash, Closest: closest}
 }
 
-// Store puts the data in the hashTable if I am one of the closest contacts and
-// sends STORE RPCs to the rest of the k-closest
+// Store puts the data in the Store if I am one of the closest contacts and
+// sends STORE RPCs to the rest of the k-closest. The data is stored as a single
+// value, which must fit in a chunk, see StoreObject for the large objects
 func (k *Kademlia) Store(data []byte) string {
+	key, _ := k.StoreContext(context.Background(), data)
+	return key
+}
+
+// StoreContext is like Store but stops waiting for the STORE responses as soon as
+// the context is done. It returns ErrNoReplicas if no node acknowledged the data
+func (k *Kademlia) StoreContext(ctx context.Context, data []byte) (string, error) {
 	// Obtain the hash from the data
 	h := sha1.New()
 	h.Write(data)
 	key := hex.EncodeToString(h.Sum(nil))
-	var ids []KademliaID
-	for _, c := range k.LookupContact(NewKademliaID(key)) { // For each of the k-closest contacts to the hash
+	k.publish(key, data)
+	k.republish(key, data, k.config.RepublishDelay) // Even if this store fails, the network may be reachable later
+	closest, err := k.LookupContactContext(ctx, NewKademliaID(key))
+	if err != nil {
+		return key, err
+	}
+	errs := make(chan error, len(closest))
+	for _, c := range closest { // For each of the k-closest contacts to the hash
 		if c.ID.Equals(k.Net.RT.me.ID) { // If I am one of the closest, I store the value
-			k.handleRPC("STORE", []string{string(data)})
-		} else { // If not send a STORE RPC to that contact
-			ids = append(ids, *k.Net.SendStoreMessage(data, &c))
+			k.handleRPC(storeRequest, [][]byte{data})
+			errs <- nil
+			continue
 		}
+		go func(c Contact) { // If not send a STORE RPC to that contact
+			errs <- k.Net.SendStoreMessageContext(ctx, data, 0, &c) // A publication
+		}(c)
 	}
-	for _, id := range ids { // For each of the alpha contacts with the STORE RPC
-		ch, _ := k.Net.RPC.Load(id) // Obtain the channel for communicating with the network layer
-		select {
-		case <-ch.(chan []string): // If the node responds
-		case <-time.After(storeTimeoutSec * time.Second): // If the node does not respond continue
+	stored := 0
+	for range closest { // Wait for every contact to respond or time out
+		if <-errs == nil {
+			stored++
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return key, err
+	}
+	if stored == 0 {
+		return key, ErrNoReplicas
+	}
+	return key, nil
+}
+
+// republish stores the data again after the delay, unless it is forgotten or the node is closed
+func (k *Kademlia) republish(key string, data []byte, delay time.Duration) {
 	ch, _ := k.forgetTable.LoadOrStore(key, make(chan interface{}))
-	go func() { // Create an anonymous parallel function
+	k.spawn(func() { // Create an anonymous parallel function
 		select {
 		case <-ch.(chan interface{}): // If a forget command was sent
 			return
-		case <-time.After(republishDelayHr * time.Hour): // If the node does not respond continue
-			k.Store(data) // Refresh the data with the topology of the network
+		case <-k.config.Clock.After(delay): // Once the delay has elapsed
+			k.StoreContext(k.ctx, data) // Refresh the data with the topology of the network
+		case <-k.ctx.Done(): // If the node is closed
 		}
-	}()
-	return key
+	})
 }
@@ -1,19 +1,27 @@
 package kademlia
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 )
 
-const localAddr = "127.0.0.1"
+const localAddr = "127.0.0.1:62000"
 const listenIP = "0.0.0.0"
 const listenPort = 62000
 
 const contactID = "fea50412207cb0a45715ed4f1b3c4b4a6f68ed57"
-const contactAddr = "142.250.74.46"
+const contactAddr = "142.250.74.46:62000"
 
 const objContent = "hello"
 const objHash = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+const objSpaced = "hello kademlia world"
+const objSpacedHash = "7b7678da0e87413d7fa7a9baeb27fdb574c3cc0f"
 
 const nullID = "0000000000000000000000000000000000000000"
 
@@ -22,7 +30,11 @@ var contact Contact
 
 func TestNewKademlia(t *testing.T) {
 	// Test kademlia initialization
-	kdm = NewKademlia(NewContact(NewRandomKademliaID(), localAddr))
+	var err error
+	kdm, err = NewKademlia(NewContact(NewRandomKademliaID(), localAddr), Config{})
+	if err != nil {
+		t.Fatalf("NewKademlia failed: %v", err)
+	}
 	// Add contact to routing table (for later use)
 	contact = NewContact(NewKademliaID(contactID), contactAddr)
 	kdm.Net.RT.AddContact(contact)
@@ -30,51 +42,68 @@ func TestNewKademlia(t *testing.T) {
 
 func TestStartListen(t *testing.T) {
 	// Start listening on default address and port
-	kdm.StartListen(listenIP, listenPort)
+	if err := kdm.StartListen(listenIP, listenPort); err != nil {
+		t.Fatalf("StartListen failed: %v", err)
+	}
 }
 
 func TestPingRPC(t *testing.T) {
-	// Simple PING should return empty string
-	if kdm.handleRPC("PING", []string{}) != "" {
-		t.Error("PING RPC failed: empty string not returned")
+	// Simple PING should return an empty PING response
+	if typ, fields := kdm.handleRPC(pingRequest, nil); typ != pingResponse || len(fields) != 0 {
+		t.Error("PING RPC failed: empty response not returned")
 	}
 }
 
 func TestStoreRPC(t *testing.T) {
-	// New object, should store it and return empty string
-	if kdm.handleRPC("STORE", []string{objContent}) != "" {
-		t.Error("STORE RPC failed: empty string not returned")
+	// New object, should store it and return an empty response
+	if typ, fields := kdm.handleRPC(storeRequest, [][]byte{[]byte(objContent)}); typ != storeResponse || len(fields) != 0 {
+		t.Error("STORE RPC failed: empty response not returned")
+	}
+	// Already existent object, should refresh it and return an empty response
+	if typ, fields := kdm.handleRPC(storeRequest, [][]byte{[]byte(objContent)}); typ != storeResponse || len(fields) != 0 {
+		t.Error("STORE RPC failed: empty response not returned")
 	}
-	// Already existent object, should refresh it and return empty string
-	if kdm.handleRPC("STORE", []string{objContent}) != "" {
-		t.Error("STORE RPC failed: empty string not returned")
+	// Values containing spaces must be stored as a whole
+	kdm.handleRPC(storeRequest, [][]byte{[]byte(objSpaced)})
+	if data, _, err := kdm.config.Store.Get(objSpacedHash); err != nil || string(data) != objSpaced {
+		t.Error("STORE RPC failed: value with spaces not stored losslessly")
 	}
 }
 
 func TestFindNodeRPC(t *testing.T) {
 	// Since we have just one node in the routing table, just that node is expected to be returned
-	expected := fmt.Sprintf("%s,%d,%s", contactAddr, listenPort, contactID)
-	if kdm.handleRPC("FIND_NODE", []string{nullID}) != expected {
+	expected := encodeContact(contact)
+	typ, fields := kdm.handleRPC(findNodeRequest, [][]byte{NewKademliaID(nullID)[:]})
+	if typ != contactsResponse || len(fields) != 1 || !bytes.Equal(fields[0], expected) {
 		t.Error("FIND_NODE failed: wrong or no node list returned")
 	}
 }
 
 func TestFindValueRPC(t *testing.T) {
 	// Object contained in the local hash table, should return its content
-	if kdm.handleRPC("FIND_VALUE", []string{objHash}) != objContent {
+	typ, fields := kdm.handleRPC(findValueRequest, [][]byte{NewKademliaID(objHash)[:]})
+	if typ != valueResponse || len(fields) != 1 || string(fields[0]) != objContent {
 		t.Error("FIND_VALUE failed: wrong or no object returned")
 	}
 	// Object not contained in the local hash table, should return the closest nodes
-	expected := fmt.Sprintf("%s,%d,%s", contactAddr, listenPort, contactID)
-	if kdm.handleRPC("FIND_VALUE", []string{nullID}) != expected {
+	expected := encodeContact(contact)
+	typ, fields = kdm.handleRPC(findValueRequest, [][]byte{NewKademliaID(nullID)[:]})
+	if typ != contactsResponse || len(fields) != 1 || !bytes.Equal(fields[0], expected) {
 		t.Error("FIND_VALUE failed: wrong or no node list returned")
 	}
 }
 
 func TestUnknownRPC(t *testing.T) {
-	// Unknown RPCs should return the empty string
-	if kdm.handleRPC("FOO", []string{}) != "" {
-		t.Error("Unknown RPC failed: empty string not returned")
+	// Unknown RPCs should not be answered
+	if typ, _ := kdm.handleRPC(messageType(0xff), nil); typ != 0 {
+		t.Error("Unknown RPC failed: response returned")
+	}
+	// Malformed RPCs should not be answered either
+	if typ, _ := kdm.handleRPC(findNodeRequest, [][]byte{[]byte("short")}); typ != 0 {
+		t.Error("Malformed RPC failed: response returned")
+	}
+	if typ, _ := kdm.handleRPC(storeRequest, [][]byte{[]byte(objContent), []byte("ttl")}); typ != 0 {
+		t.Error("Malformed RPC failed: response returned for a STORE with a short time to live")
 	}
 }
 
@@ -117,6 +146,20 @@ func TestForget(t *testing.T) {
 	}
 }
 
+func TestStoreFailureKeepsRepublishing(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	key, err := nodes[0].StoreContext(ctx, []byte("stored later"))
+	if err == nil {
+		t.Fatal("StoreContext succeeded with a cancelled context")
+	}
+	// The value is still republished, and can be forgotten
+	if !nodes[0].ForgetData(key) {
+		t.Error("ForgetData failed: the value is not republished after the failed store")
+	}
+}
+
 func TestSendPingMessage(t *testing.T) {
 	// Simple ping message to the test contact
 	kdm.Net.SendPingMessage(&contact)
@@ -126,3 +169,103 @@ func TestUpdateRoutingTable(t *testing.T) {
 	// Update routing table with the test contact
 	kdm.Net.updateRoutingTable(contact)
 }
+
+func TestShutdown(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	// Store an object on the first node only
+	nodes[0].handleRPC(storeRequest, [][]byte{[]byte(objContent)})
+	// Leaving the network should hand the object off to the other nodes
+	if err := nodes[0].Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	for i, n := range nodes[1:] {
+		if data, _, err := n.config.Store.Get(objHash); err != nil || string(data) != objContent {
+			t.Errorf("Shutdown failed: object not handed off to node %d", i+1)
+		}
+	}
+}
+
+func TestRejoin(t *testing.T) {
+	nodes := newTestCluster(t, 10)
+	mn := nodes[0].Net.Transport.(*MemoryTransport).network
+	node := nodes[len(nodes)-1]
+	dead := deadContactsNear(node.Net.RT.me.ID, 1)[0]
+	node.Net.RT.AddContact(dead)
+	path := filepath.Join(t.TempDir(), "routes")
+	if err := node.Net.RT.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	// The node restarts on another port while the bootstrap node is down,
+	// and already evicted by the rest of the network
+	node.Close()
+	nodes[0].Close()
+	for _, n := range nodes[1 : len(nodes)-1] {
+		n.Net.RT.RemoveContact(nodes[0].Net.RT.me.ID)
+	}
+	restarted := newTestNode(t, mn, node.Net.RT.me.ID, listenPort+len(nodes))
+	if err := restarted.Rejoin(); !errors.Is(err, ErrNoContacts) {
+		t.Errorf("Rejoin failed: %v returned without any contact", err)
+	}
+	if err := restarted.Net.RT.Load(path); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := restarted.Rejoin(); err != nil {
+		t.Fatalf("Rejoin failed: %v", err)
+	}
+	// The contacts that did not respond are gone, the others can be found
+	for _, c := range []Contact{dead, nodes[0].Net.RT.me} {
+		if restarted.Net.RT.hasContact(c.ID) {
+			t.Errorf("Rejoin failed: %s still in the routing table", c.Address)
+		}
+	}
+	target := nodes[1].Net.RT.me.ID
+	if found := restarted.LookupContact(target); len(found) == 0 || !found[0].ID.Equals(target) {
+		t.Error("LookupContact failed: node not found after rejoining")
+	}
+}
+
+func TestCloseReleasesRoutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	nodes := newTestCluster(t, 10)
+	for i := 0; i < 3; i++ { // Start some expiration and republishing routines
+		nodes[i].Store([]byte(fmt.Sprintf("object %d", i)))
+	}
+	// An RPC waiting for a dead contact should fail as soon as the node is closed
+	dead := deadContactsNear(nodes[0].Net.RT.me.ID, 1)[0]
+	errs := make(chan error)
+	go func() { errs <- nodes[0].Net.SendPingMessageContext(context.Background(), &dead) }()
+	time.Sleep(10 * time.Millisecond)
+	for _, n := range nodes {
+		if err := n.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	}
+	if err := <-errs; !errors.Is(err, ErrClosed) {
+		t.Errorf("Close failed: pending RPC returned %v instead of ErrClosed", err)
+	}
+	// Every routine of the nodes should be gone
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Close failed: %d routines leaked", after-before)
+	}
+	// Closing twice is harmless
+	if err := nodes[0].Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	// Close the node listening on the default address and port
+	if err := kdm.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	// The port should be available again
+	other, _ := NewKademlia(NewContact(NewRandomKademliaID(), localAddr), Config{})
+	if err := other.StartListen(listenIP, listenPort); err != nil {
+		t.Errorf("Close failed: port still bound (%v)", err)
+	}
+	other.Close()
+}
@@ -1,8 +1,9 @@
 package kademlia
 
 import (
+	"crypto/rand"
 	"encoding/hex"
-	"math/rand"
+	"fmt"
 )
 
 // the static number of bytes in a KademliaID
@@ -23,12 +24,28 @@ func NewKademliaID(data string) *KademliaID {
 	return &newKademliaID
 }
 
-// NewRandomKademliaID returns a new instance of a random KademliaID,
-// change this to a better version if you like
+// ParseKademliaID returns the KademliaID represented by the hexadecimal string,
+// or an error if the string is not a valid 160-bit hexadecimal value
+func ParseKademliaID(data string) (*KademliaID, error) {
+	decoded, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != IDLength {
+		return nil, fmt.Errorf("invalid ID length: expected %d bytes, %d found", IDLength, len(decoded))
+	}
+	id := KademliaID{}
+	copy(id[:], decoded)
+	return &id, nil
+}
+
+// NewRandomKademliaID returns a new instance of a random KademliaID, read from
+// the cryptographically secure random number generator of the system. Since no
+// ID can be safely generated without it, a failure of the generator panics
 func NewRandomKademliaID() *KademliaID {
 	newKademliaID := KademliaID{}
-	for i := 0; i < IDLength; i++ {
-		newKademliaID[i] = uint8(rand.Intn(256))
+	if _, err := rand.Read(newKademliaID[:]); err != nil {
+		panic(fmt.Sprintf("kademlia: unable to generate a random ID: %v", err))
 	}
 	return &newKademliaID
 }
@@ -67,3 +84,18 @@ func (kademliaID KademliaID) CalcDistance(target *KademliaID) *KademliaID {
 func (kademliaID *KademliaID) String() string {
 	return hex.EncodeToString(kademliaID[0:IDLength])
 }
+
+// MarshalText encodes the KademliaID as its hexadecimal string, as in JSON
+func (kademliaID KademliaID) MarshalText() ([]byte, error) {
+	return []byte(kademliaID.String()), nil
+}
+
+// UnmarshalText decodes a KademliaID encoded by MarshalText
+func (kademliaID *KademliaID) UnmarshalText(text []byte) error {
+	id, err := ParseKademliaID(string(text))
+	if err != nil {
+		return err
+	}
+	*kademliaID = *id
+	return nil
+}
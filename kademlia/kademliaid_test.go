@@ -0,0 +1,53 @@
+package kademlia
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+)
+
+func TestRandomKademliaIDUnpredictable(t *testing.T) {
+	// Seeding the math/rand generator, as every node used to do with the
+	// last octet of its IP, must not make the IDs reproducible
+	rand.Seed(3)
+	first := NewRandomKademliaID()
+	rand.Seed(3)
+	if second := NewRandomKademliaID(); first.Equals(second) {
+		t.Error("NewRandomKademliaID failed: IDs depend on the math/rand seed")
+	}
+	// IDs should never repeat
+	seen := make(map[KademliaID]bool)
+	for i := 0; i < 10000; i++ {
+		id := NewRandomKademliaID()
+		if seen[*id] {
+			t.Fatalf("NewRandomKademliaID failed: %s generated twice", id)
+		}
+		seen[*id] = true
+	}
+}
+
+func TestParseKademliaID(t *testing.T) {
+	if id, err := ParseKademliaID(contactID); err != nil || id.String() != contactID {
+		t.Error("ParseKademliaID failed: valid ID rejected")
+	}
+	for _, invalid := range []string{"", "zz", contactID[:38], contactID + "00"} {
+		if _, err := ParseKademliaID(invalid); err == nil {
+			t.Errorf("ParseKademliaID failed: %q accepted", invalid)
+		}
+	}
+}
+
+func TestKademliaIDJSON(t *testing.T) {
+	id := NewKademliaID(contactID)
+	data, err := json.Marshal(id)
+	if err != nil || string(data) != `"`+contactID+`"` {
+		t.Fatalf("MarshalText failed: %s (%v)", data, err)
+	}
+	var decoded KademliaID
+	if err := json.Unmarshal(data, &decoded); err != nil || !decoded.Equals(id) {
+		t.Errorf("UnmarshalText failed: %s (%v)", decoded.String(), err)
+	}
+	if err := json.Unmarshal([]byte(`"0123"`), &decoded); err == nil {
+		t.Error("UnmarshalText failed: short ID accepted")
+	}
+}
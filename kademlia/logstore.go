@@ -0,0 +1,399 @@
+package kademlia
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const logStoreName = "values.log"     // Name of the log in the directory of a LogStore
+const logStoreCompactExt = ".compact" // Extension of the log being rewritten by a compaction
+const logStoreFileMode = 0600         // Permissions of the log
+const logStoreCompactSize = 1 << 20   // Size of the log under which it is never compacted
+const logRecordHeaderSize = 8         // CRC-32 of the payload of a record and its length
+const logRecordFixedSize = 13         // Operation, time and key length at the start of the payload
+const logRecordMaxSize = 1 << 30      // Length beyond which a payload is considered corrupt
+
+var errCorruptRecord = errors.New("torn or corrupt log record")
+
+// logOp definition
+// identifies the operation recorded by a record of the log
+type logOp byte
+
+const (
+	logPut       logOp = iota + 1 // A value and its expiration time
+	logTouch                      // The new expiration time of a value
+	logDelete                     // The removal of a value
+	logPublish                    // A value published by the node and its publication time
+	logUnpublish                  // The removal of a publication
+)
+
+// logRecord definition
+// stores an operation of the log. The time is the expiration time of the
+// values and the publication time of the publications
+type logRecord struct {
+	op    logOp
+	key   string
+	value []byte
+	at    time.Time
+}
+
+// size returns the number of bytes taken by the record in the log
+func (r *logRecord) size() int64 {
+	return int64(logRecordHeaderSize + logRecordFixedSize + len(r.key) + len(r.value))
+}
+
+// encode returns the record as written in the log: a header with the checksum and the
+// length of the payload, followed by the operation, the time, the key length, the key
+// and the value
+func (r *logRecord) encode() []byte {
+	data := make([]byte, r.size())
+	payload := data[logRecordHeaderSize:]
+	payload[0] = byte(r.op)
+	copy(payload[1:], encodeExpiration(r.at))
+	binary.BigEndian.PutUint32(payload[9:], uint32(len(r.key)))
+	copy(payload[logRecordFixedSize:], r.key)
+	copy(payload[logRecordFixedSize+len(r.key):], r.value)
+	binary.BigEndian.PutUint32(data, crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(data[4:], uint32(len(payload)))
+	return data
+}
+
+// readLogRecord reads the next record of the log. It returns io.EOF at the end of the
+// log and errCorruptRecord if the record is incomplete or does not match its checksum
+func readLogRecord(r io.Reader) (logRecord, error) {
+	header := make([]byte, logRecordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errCorruptRecord
+		}
+		return logRecord{}, err
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < logRecordFixedSize || length > logRecordMaxSize {
+		return logRecord{}, errCorruptRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errCorruptRecord
+		}
+		return logRecord{}, err
+	}
+	keyLength := binary.BigEndian.Uint32(payload[9:])
+	op := logOp(payload[0])
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header) ||
+		keyLength > length-logRecordFixedSize || op < logPut || op > logUnpublish {
+		return logRecord{}, errCorruptRecord
+	}
+	key := payload[logRecordFixedSize : logRecordFixedSize+keyLength]
+	return logRecord{
+		op:    op,
+		key:   string(key),
+		value: payload[logRecordFixedSize+keyLength:],
+		at:    decodeExpiration(payload[1:]),
+	}, nil
+}
+
+// logEntry definition
+// stores a value of a LogStore with its expiration time, or a publication with its publication time
+type logEntry struct {
+	value []byte
+	at    time.Time
+}
+
+// LogStore definition
+// implements the PublicationStore interface with an append-only log, kept in a directory,
+// that records every change to the values and to the publications of the node, so that they
+// survive a restart. The contents are also kept in memory to serve the reads. Every change is
+// synced to disk before it is acknowledged, and the log is compacted by rewriting only the
+// records still needed once they take less than half of it. A record torn by a crash is dropped
+// when the log is opened again, along with everything after it
+type LogStore struct {
+	mu           sync.RWMutex
+	path         string
+	file         *os.File // Log opened for appending, nil once closed
+	size         int64    // Bytes in the log
+	live         int64    // Bytes of the records needed to rebuild the contents
+	values       map[string]logEntry
+	publications map[string]logEntry
+}
+
+// NewLogStore returns a new instance of a LogStore keeping its log in the directory specified,
+// which is created if needed. The values and the publications already in the log are loaded,
+// the values expired in the meantime are left to Expire, called with the clock of the node
+func NewLogStore(dir string) (*LogStore, error) {
+	if err := os.MkdirAll(dir, fileStoreDirMode); err != nil {
+		return nil, err
+	}
+	s := &LogStore{
+		path:         filepath.Join(dir, logStoreName),
+		values:       make(map[string]logEntry),
+		publications: make(map[string]logEntry),
+	}
+	// Left behind by a compaction interrupted by a crash, the log is still complete
+	if err := os.Remove(s.path + logStoreCompactExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, logStoreFileMode)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		record, err := readLogRecord(r)
+		if errors.Is(err, errCorruptRecord) {
+			err = f.Truncate(s.size) // Drop the torn record, the next ones are appended in its place
+			if err == nil {
+				break
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		s.size += record.size()
+		s.apply(record)
+	}
+	s.file = f
+	if err := s.compactIfNeeded(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Put appends a record of the value to the log
+func (s *LogStore) Put(key string, value []byte, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(logRecord{op: logPut, key: key, value: append([]byte(nil), value...), at: expires})
+}
+
+// Get returns a copy of the value stored under the key and its expiration time
+func (s *LogStore) Get(key string) ([]byte, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.values[key]
+	if !ok {
+		return nil, time.Time{}, ErrNotFound
+	}
+	return append([]byte(nil), entry.value...), entry.at, nil
+}
+
+// Touch appends a record of the new expiration time of the value to the log
+func (s *LogStore) Touch(key string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.values[key]; !ok {
+		return ErrNotFound
+	}
+	return s.append(logRecord{op: logTouch, key: key, at: expires})
+}
+
+// Delete appends a record of the removal of the value to the log, if it is stored
+func (s *LogStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.values[key]; !ok {
+		return nil
+	}
+	return s.append(logRecord{op: logDelete, key: key})
+}
+
+// Range calls f for a copy of every value stored until f returns false
+func (s *LogStore) Range(f func(key string, value []byte, expires time.Time) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, entry := range s.values {
+		if !f(key, append([]byte(nil), entry.value...), entry.at) {
+			break
+		}
+	}
+	return nil
+}
+
+// Expire appends a record of the removal of every value expired at now to the log
+func (s *LogStore) Expire(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []logRecord
+	for key, entry := range s.values {
+		if expired(entry.at, now) {
+			records = append(records, logRecord{op: logDelete, key: key})
+		}
+	}
+	return s.append(records...)
+}
+
+// Publish appends a record of the publication of the value to the log
+func (s *LogStore) Publish(key string, value []byte, published time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(logRecord{op: logPublish, key: key, value: append([]byte(nil), value...), at: published})
+}
+
+// Unpublish appends a record of the removal of the publication to the log, if there is one
+func (s *LogStore) Unpublish(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.publications[key]; !ok {
+		return nil
+	}
+	return s.append(logRecord{op: logUnpublish, key: key})
+}
+
+// RangePublished calls f for a copy of every value published until f returns false
+func (s *LogStore) RangePublished(f func(key string, value []byte, published time.Time) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, entry := range s.publications {
+		if !f(key, append([]byte(nil), entry.value...), entry.at) {
+			break
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the log with only the records needed to rebuild the contents
+func (s *LogStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	return s.compact()
+}
+
+// Close closes the log, every change is already synced to disk
+func (s *LogStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// append writes the records at the end of the log, syncs it and applies them to the contents.
+// If the write or the sync fails the log is cut back to the records applied, so that the next
+// records do not follow a torn one and the size of the log stays accounted for
+func (s *LogStore) append(records ...logRecord) error {
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	var data []byte
+	for i := range records {
+		data = append(data, records[i].encode()...)
+	}
+	_, err := s.file.Write(data)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		s.file.Truncate(s.size)
+		return err
+	}
+	s.size += int64(len(data))
+	for _, record := range records {
+		s.apply(record)
+	}
+	return s.compactIfNeeded()
+}
+
+// apply updates the contents with the record, keeping track of the bytes still needed
+func (s *LogStore) apply(record logRecord) {
+	entry := logEntry{value: record.value, at: record.at}
+	switch record.op {
+	case logPut:
+		s.remove(s.values, record.key)
+		s.values[record.key] = entry
+		s.live += record.size()
+	case logTouch:
+		if stored, ok := s.values[record.key]; ok {
+			stored.at = record.at
+			s.values[record.key] = stored
+		}
+	case logDelete:
+		s.remove(s.values, record.key)
+	case logPublish:
+		s.remove(s.publications, record.key)
+		s.publications[record.key] = entry
+		s.live += record.size()
+	case logUnpublish:
+		s.remove(s.publications, record.key)
+	}
+}
+
+// remove deletes the key from the entries specified, which no longer need its record
+func (s *LogStore) remove(entries map[string]logEntry, key string) {
+	if entry, ok := entries[key]; ok {
+		s.live -= (&logRecord{key: key, value: entry.value}).size()
+		delete(entries, key)
+	}
+}
+
+// compactIfNeeded compacts the log once it is large enough and mostly made of records no longer needed
+func (s *LogStore) compactIfNeeded() error {
+	if s.size < logStoreCompactSize || s.size <= 2*s.live {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact writes the records needed to rebuild the contents to a new log, which then atomically
+// replaces the current one. A crash in the meantime leaves the current log untouched
+func (s *LogStore) compact() error {
+	tmp := s.path + logStoreCompactExt
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, logStoreFileMode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // Only left behind if something failed
+	w := bufio.NewWriter(f)
+	write := func(op logOp, entries map[string]logEntry) {
+		for key, entry := range entries {
+			w.Write((&logRecord{op: op, key: key, value: entry.value, at: entry.at}).encode())
+		}
+	}
+	write(logPut, s.values)
+	write(logPublish, s.publications)
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil { // Make the rename durable
+		dir.Sync()
+		dir.Close()
+	}
+	s.file.Close()
+	if s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		s.file = nil
+		return err
+	}
+	s.size = s.live
+	return nil
+}
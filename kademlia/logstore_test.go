@@ -0,0 +1,278 @@
+package kademlia_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matteocarnelos/kadlab/kademlia"
+	"github.com/matteocarnelos/kadlab/kademlia/storetest"
+)
+
+// openLogStore returns the LogStore kept in the directory specified or fails the test
+func openLogStore(t *testing.T, dir string) *kademlia.LogStore {
+	t.Helper()
+	s, err := kademlia.NewLogStore(dir)
+	if err != nil {
+		t.Fatalf("NewLogStore failed: %v", err)
+	}
+	return s
+}
+
+// logSize returns the size of the log of the LogStore kept in the directory specified
+func logSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	info, err := os.Stat(filepath.Join(dir, "values.log"))
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	return info.Size()
+}
+
+func TestLogStore(t *testing.T) {
+	storetest.TestStore(t, func(t *testing.T) kademlia.Store {
+		return openLogStore(t, t.TempDir())
+	})
+}
+
+func TestLogStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openLogStore(t, dir)
+	now := time.Now().Round(0)
+	expires := now.Add(time.Hour)
+	published := now.Add(-time.Minute)
+	s.Put("kept", []byte("value"), now)
+	s.Put("kept", []byte("overwritten"), expires)
+	s.Put("touched", []byte("value"), expires)
+	s.Touch("touched", time.Time{})
+	s.Put("deleted", []byte("value"), expires)
+	s.Delete("deleted")
+	s.Put("expired", []byte("value"), now)
+	s.Publish("published", []byte("mine"), published)
+	s.Publish("unpublished", []byte("mine"), published)
+	s.Unpublish("unpublished")
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := s.Put("closed", []byte("value"), expires); err == nil {
+		t.Errorf("Put succeeded on a closed LogStore")
+	}
+
+	s = openLogStore(t, dir)
+	defer s.Close()
+	// Expired values are only dropped by Expire, at the time of the clock of the node
+	if _, _, err := s.Get("expired"); err != nil {
+		t.Errorf("Reopen failed: expired value dropped before Expire (%v)", err)
+	}
+	s.Expire(now)
+	values := make(map[string]string)
+	s.Range(func(key string, value []byte, expires time.Time) bool {
+		values[key] = fmt.Sprintf("%s@%v", value, expires.UnixNano())
+		return true
+	})
+	expected := map[string]string{
+		"kept":    fmt.Sprintf("overwritten@%v", expires.UnixNano()),
+		"touched": fmt.Sprintf("value@%v", time.Time{}.UnixNano()),
+	}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("Reopen failed: %v values loaded instead of %v", values, expected)
+	}
+	count := 0
+	s.RangePublished(func(key string, value []byte, at time.Time) bool {
+		count++
+		if key != "published" || string(value) != "mine" || !at.Equal(published) {
+			t.Errorf("Reopen failed: publication %q of %q at %v loaded", key, value, at)
+		}
+		return true
+	})
+	if count != 1 {
+		t.Errorf("Reopen failed: %d publications loaded", count)
+	}
+}
+
+func TestLogStoreTruncated(t *testing.T) {
+	// Build a log and remember where each of its records ends
+	dir := t.TempDir()
+	s := openLogStore(t, dir)
+	const count = 4
+	var ends []int64
+	for i := 0; i < count; i++ {
+		s.Put(fmt.Sprintf("key%d", i), bytes.Repeat([]byte{byte(i)}, 10*i), time.Time{})
+		ends = append(ends, logSize(t, dir))
+	}
+	s.Close()
+	log, err := ioutil.ReadFile(filepath.Join(dir, "values.log"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	// A crash can cut the log at any byte, the records completed before it must survive
+	for cut := int64(0); cut <= int64(len(log)); cut++ {
+		crashed := t.TempDir()
+		ioutil.WriteFile(filepath.Join(crashed, "values.log"), log[:cut], 0600)
+		s := openLogStore(t, crashed)
+		complete := 0
+		for complete < count && ends[complete] <= cut {
+			complete++
+		}
+		for i := 0; i < count; i++ {
+			_, _, err := s.Get(fmt.Sprintf("key%d", i))
+			if (err == nil) != (i < complete) {
+				t.Fatalf("Log cut at %d: Get(key%d) returned %v with %d complete records", cut, i, err, complete)
+			}
+		}
+		// The torn record is dropped, so that the next ones are not lost behind it
+		if err := s.Put("after", []byte("crash"), time.Time{}); err != nil {
+			t.Fatalf("Log cut at %d: Put failed: %v", cut, err)
+		}
+		s.Close()
+		s = openLogStore(t, crashed)
+		if value, _, err := s.Get("after"); err != nil || string(value) != "crash" {
+			t.Errorf("Log cut at %d: the value stored after the crash is lost: %q (%v)", cut, value, err)
+		}
+		s.Close()
+	}
+}
+
+func TestLogStoreCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	s := openLogStore(t, dir)
+	s.Put("first", []byte("value"), time.Time{})
+	s.Put("second", []byte("value"), time.Time{})
+	s.Close()
+	path := filepath.Join(dir, "values.log")
+	log, _ := ioutil.ReadFile(path)
+	log[len(log)-1] ^= 0xff // Flip the last byte of the value of the second record
+	ioutil.WriteFile(path, log, 0600)
+	s = openLogStore(t, dir)
+	defer s.Close()
+	if _, _, err := s.Get("first"); err != nil {
+		t.Errorf("Get of the intact record failed: %v", err)
+	}
+	if value, _, err := s.Get("second"); err == nil {
+		t.Errorf("Get of the corrupt record returned %q", value)
+	}
+}
+
+func TestLogStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	s := openLogStore(t, dir)
+	for i := 0; i < 100; i++ {
+		s.Put("key", []byte(fmt.Sprintf("value%d", i)), time.Time{})
+		s.Touch("key", time.Time{})
+	}
+	s.Put("deleted", []byte("value"), time.Time{})
+	s.Delete("deleted")
+	s.Publish("published", []byte("mine"), time.Time{})
+	before := logSize(t, dir)
+	if err := s.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	after := logSize(t, dir)
+	if after >= before/10 {
+		t.Errorf("Compact failed: the log went from %d to %d bytes", before, after)
+	}
+	s.Put("other", []byte("value"), time.Time{}) // Appended to the compacted log
+	s.Close()
+
+	// A compaction interrupted by a crash leaves its partial log behind, which is discarded
+	ioutil.WriteFile(filepath.Join(dir, "values.log.compact"), []byte("partial"), 0600)
+	s = openLogStore(t, dir)
+	if value, _, err := s.Get("key"); err != nil || string(value) != "value99" {
+		t.Errorf("Get after Compact returned %q (%v)", value, err)
+	}
+	if _, _, err := s.Get("other"); err != nil {
+		t.Errorf("Get after Compact failed: %v", err)
+	}
+	if _, _, err := s.Get("deleted"); err == nil {
+		t.Errorf("Compact restored a deleted value")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "values.log.compact")); !os.IsNotExist(err) {
+		t.Errorf("The partial log of an interrupted compaction is left behind (%v)", err)
+	}
+
+	// Overwriting a large value compacts the log on its own
+	large := make([]byte, 64<<10)
+	for i := 0; i < 40; i++ {
+		large[0] = byte(i)
+		if err := s.Put("large", large, time.Time{}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if size := logSize(t, dir); size > 1<<20 { // Instead of 40 times the value
+		t.Errorf("The log was not compacted: %d bytes for a value of %d", size, len(large))
+	}
+	s.Close()
+	s = openLogStore(t, dir)
+	defer s.Close()
+	if value, _, err := s.Get("large"); err != nil || !bytes.Equal(value, large) {
+		t.Errorf("Get of the large value failed after the compactions (%v)", err)
+	}
+}
+
+func TestLogStoreResumesRepublishing(t *testing.T) {
+	dir := t.TempDir()
+	mn := kademlia.NewMemoryNetwork()
+	start := func(addr string, config kademlia.Config) *kademlia.Kademlia {
+		node, err := kademlia.NewKademlia(kademlia.NewContact(kademlia.NewRandomKademliaID(), addr), config)
+		if err != nil {
+			t.Fatalf("NewKademlia failed: %v", err)
+		}
+		tr, _ := mn.Listen(addr)
+		if err := node.StartTransport(tr); err != nil {
+			t.Fatalf("StartTransport failed: %v", err)
+		}
+		return node
+	}
+	startPublisher := func() *kademlia.Kademlia {
+		return start("127.0.0.1:62000", kademlia.Config{Store: openLogStore(t, dir), RepublishDelay: 300 * time.Millisecond})
+	}
+	held := kademlia.NewMemoryStore()
+	holder := start("127.0.0.1:62001", kademlia.Config{Store: held})
+	defer holder.Close()
+	publisher := startPublisher()
+	if err := publisher.Join("127.0.0.1:62001"); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	hash, err := publisher.StoreContext(context.Background(), []byte("republished"))
+	if err != nil {
+		t.Fatalf("StoreContext failed: %v", err)
+	}
+	publisher.Close() // Before any republishing
+	// Drop the replicas, so that only the publication can bring the value back
+	held.Delete(hash)
+	s := openLogStore(t, dir)
+	s.Delete(hash)
+	s.Close()
+
+	// The restarted publisher stores the value again once it reaches the network
+	publisher = startPublisher()
+	if err := publisher.Join("127.0.0.1:62001"); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, _, err := held.Get(hash); err != nil; _, _, err = held.Get(hash) {
+		if time.Now().After(deadline) {
+			t.Fatalf("The value was not republished after the restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !publisher.ForgetData(hash) {
+		t.Errorf("ForgetData failed: the resumed publication is unknown")
+	}
+	publisher.Close()
+
+	// A forgotten value is not resumed
+	publisher = startPublisher()
+	defer publisher.Close()
+	if err := publisher.Join("127.0.0.1:62001"); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	if publisher.ForgetData(hash) {
+		t.Errorf("ForgetData succeeded: the forgotten publication was resumed")
+	}
+}
@@ -0,0 +1,221 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"time"
+)
+
+// lookupStrategy definition
+// defines the RPC a lookup sends to each contact and how it handles the responses
+type lookupStrategy interface {
+	// send sends the lookup RPC to the recipient and returns the ID of the RPC
+	// together with the channel its response will be delivered to
+	send(n *Network, recipient *Contact) (*KademliaID, <-chan *message, error)
+	// handle processes a response, returning the contacts it carries and true if the
+	// lookup should stop right away, or an error if the response is not acceptable
+	handle(from Contact, resp *message) ([]Contact, bool, error)
+}
+
+// lookupResult definition
+// stores the outcome of a contact queried during a lookup: its response, or nil
+// if it stalled (still waiting) or timed out (gave up)
+type lookupResult struct {
+	contact Contact
+	resp    *message
+	stalled bool
+}
+
+// Possible states of a contact in the shortlist of a lookup
+const (
+	lookupCandidate = iota // Not queried yet
+	lookupInFlight         // Queried, waiting for its response
+	lookupStalled          // Queried, slow to respond, no longer counted as in flight
+	lookupAnswered         // Responded to the query
+	lookupFailed           // Did not respond in time
+)
+
+// iterativeLookup runs the iterative node lookup for the target with the strategy specified.
+// It keeps alpha RPCs in flight, moves on as soon as any of them is answered or
+// stalls, and stops when the k closest contacts seen that did not fail have
+// all answered, returning them. If the context is done first, the closest contacts seen so
+// far are returned together with the context error
+func (k *Kademlia) iterativeLookup(ctx context.Context, target *KademliaID, strategy lookupStrategy) ([]Contact, error) {
+	var shortlist ContactCandidates
+	state := make(map[string]int)
+	results := make(chan lookupResult)
+	done := make(chan struct{}) // Closed at the end of the lookup to release the pending queries
+	defer close(done)
+	inFlight := 0
+	// add appends the contacts never seen before to the shortlist, with the liveness
+	// metadata of the routing table, skipping the ones known to be dead
+	add := func(contacts []Contact) {
+		for _, c := range contacts {
+			if _, ok := state[c.Address]; ok {
+				continue
+			} // If it has already been seen, continue to the next
+			if known, ok := k.Net.RT.lookupContact(c.ID); ok && sameAddress(known.Address, c.Address) {
+				if known.dead() {
+					state[c.Address] = lookupFailed
+					continue
+				}
+				c.RTT = known.RTT // Used to prefer the fastest address of a node
+			}
+			c.CalcDistance(target)
+			shortlist.Append([]Contact{c})
+			if c.ID.Equals(k.Net.RT.me.ID) { // I am never queried, consider it answered
+				state[c.Address] = lookupAnswered
+			} else {
+				state[c.Address] = lookupCandidate
+			}
+		}
+	}
+	k.Net.RT.touchBucket(target, k.config.Clock.Now()) // The bucket no longer needs a refresh
+	add(k.Net.RT.FindClosestContacts(target, k.config.K))
+	for {
+		shortlist.Sort() // Sort the contacts by their distance
+		var closest []Contact
+		finished := true
+		for _, c := range shortlist.contacts { // For each of the k-closest contacts that did not fail
+			if len(closest) == k.config.K {
+				break
+			}
+			switch state[c.Address] {
+			case lookupFailed:
+				continue
+			case lookupCandidate:
+				if inFlight < k.config.Alpha { // Keep alpha RPCs in flight
+					state[c.Address] = lookupInFlight
+					inFlight++
+					go k.query(strategy, c, results, done)
+				}
+				finished = false
+			case lookupInFlight, lookupStalled:
+				finished = false
+			}
+			closest = append(closest, c)
+		}
+		if finished { // If all the k-closest contacts answered
+			return closest, nil
+		}
+		var r lookupResult
+		select {
+		case r = <-results: // Wait for the first outcome
+		case <-ctx.Done(): // Give up, the pending queries are released by done
+			return closest, ctx.Err()
+		}
+		if state[r.contact.Address] == lookupInFlight {
+			inFlight-- // The slot is free, whatever the outcome
+		}
+		switch {
+		case r.stalled: // Keep waiting for it, but query someone else in the meantime
+			state[r.contact.Address] = lookupStalled
+		case r.resp == nil: // If the contact did not respond
+			state[r.contact.Address] = lookupFailed
+		default:
+			contacts, stop, err := strategy.handle(r.contact, r.resp)
+			if err != nil { // If the contact misbehaved, drop it and carry on with the others
+				fmt.Printf("%s -> rejected: %v\n", r.contact.Address, err)
+				state[r.contact.Address] = lookupFailed
+				if r.resp.SenderID == *r.contact.ID { // The ID of a contact that answers under another one is only hearsay
+					k.Net.RT.PenalizeContact(r.contact, k.config.Clock.Now())
+				}
+				continue
+			}
+			state[r.contact.Address] = lookupAnswered
+			if stop {
+				return closest, nil
+			}
+			add(contacts)
+		}
+	}
+}
+
+// query sends the lookup RPC to the contact and reports its outcome to results
+// until the lookup is done
+func (k *Kademlia) query(strategy lookupStrategy, contact Contact, results chan<- lookupResult, done <-chan struct{}) {
+	report := func(r lookupResult) bool {
+		select {
+		case results <- r:
+			return true
+		case <-done: // The lookup is already over
+			return false
+		}
+	}
+	id, ch, err := strategy.send(&k.Net, &contact)
+	if err != nil { // If the RPC could not be sent, the contact failed
+		report(lookupResult{contact: contact})
+		return
+	}
+	stall := time.NewTimer(k.config.StallTimeout)
+	defer stall.Stop()
+	select {
+	case resp := <-ch: // If the node responds quickly (nil if the RPC failed)
+		if resp == nil {
+			k.Net.failed(&contact, k.Net.failure())
+		}
+		report(lookupResult{contact: contact, resp: resp})
+		return
+	case <-stall.C: // If the node is slow
+		if !report(lookupResult{contact: contact, stalled: true}) {
+			k.Net.pending.cancel(*id) // Stop waiting for the response
+			return
+		}
+	case <-done:
+		k.Net.pending.cancel(*id)
+		return
+	}
+	select {
+	case resp := <-ch: // If the node eventually responds (nil if the RPC failed)
+		if resp == nil {
+			k.Net.failed(&contact, k.Net.failure())
+		}
+		report(lookupResult{contact: contact, resp: resp})
+	case <-done:
+		k.Net.pending.cancel(*id)
+	}
+}
+
+// findNodeStrategy definition
+// implements the lookupStrategy for the FIND_NODE RPC
+type findNodeStrategy struct {
+	target *KademliaID
+}
+
+func (s *findNodeStrategy) send(n *Network, recipient *Contact) (*KademliaID, <-chan *message, error) {
+	return n.sendRPC(recipient, findNodeRequest, s.target[:])
+}
+
+func (s *findNodeStrategy) handle(_ Contact, resp *message) ([]Contact, bool, error) {
+	return decodeContacts(resp.Fields), false, nil
+}
+
+// findValueStrategy definition
+// implements the lookupStrategy for the FIND_VALUE RPC, stopping as soon as the value is found.
+// A value whose SHA1 is not the target is rejected, so that no node can answer with forged content
+type findValueStrategy struct {
+	target *KademliaID
+	value  []byte
+	found  bool
+}
+
+func (s *findValueStrategy) send(n *Network, recipient *Contact) (*KademliaID, <-chan *message, error) {
+	return n.sendRPC(recipient, findValueRequest, s.target[:])
+}
+
+func (s *findValueStrategy) handle(_ Contact, resp *message) ([]Contact, bool, error) {
+	if resp.Type == valueResponse && len(resp.Fields) == 1 { // If the message contains the value
+		if !matches(resp.Fields[0], s.target) {
+			return nil, false, fmt.Errorf("%w: value for %s", ErrForgedValue, s.target.String())
+		}
+		s.value, s.found = resp.Fields[0], true
+		return nil, true, nil
+	}
+	return decodeContacts(resp.Fields), false, nil
+}
+
+// matches returns true if the SHA1 of the value is the key, as for every value stored
+func matches(value []byte, key *KademliaID) bool {
+	return KademliaID(sha1.Sum(value)) == *key
+}
@@ -0,0 +1,310 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// deadContactsNear returns count contacts that are closer to the target than any
+// other node of the network but that never respond
+func deadContactsNear(target *KademliaID, count int) []Contact {
+	var contacts []Contact
+	for i := 0; i < count; i++ {
+		id := *target
+		id[IDLength-1] ^= byte(i + 1)
+		contacts = append(contacts, NewContact(&id, net.JoinHostPort("127.0.0.2", strconv.Itoa(i+1))))
+	}
+	return contacts
+}
+
+func TestLookupDataSkipsDeadContacts(t *testing.T) {
+	nodes := newTestCluster(t, clusterSize)
+	data := []byte("hidden behind dead nodes")
+	h := sha1.Sum(data)
+	hash := hex.EncodeToString(h[:])
+	nodes[1].Store(data)
+	// The closest contacts known by the reader are all dead: they occupy the
+	// alpha slots first, and the lookup must move on without waiting for them
+	var reader *Kademlia
+	for _, n := range nodes { // Pick a node that does not hold a replica
+		if _, _, err := n.config.Store.Get(hash); err != nil {
+			reader = n
+		}
+	}
+	for _, c := range deadContactsNear(NewKademliaID(hash), concurrencyParam) {
+		reader.Net.RT.AddContact(c)
+	}
+	start := time.Now()
+	if found, ok := reader.LookupData(hash); !ok || found != string(data) {
+		t.Fatal("LookupData failed: object not found")
+	}
+	if elapsed := time.Since(start); elapsed >= findTimeoutSec*time.Second {
+		t.Errorf("LookupData failed: stalled for %s on dead contacts", elapsed)
+	}
+}
+
+func TestLookupContactConverges(t *testing.T) {
+	nodes := newTestCluster(t, clusterSize)
+	// The lookup should return the k-closest nodes of the network, sorted
+	target := NewRandomKademliaID()
+	var all ContactCandidates
+	for _, n := range nodes {
+		c := n.Net.RT.me
+		c.CalcDistance(target)
+		all.Append([]Contact{c})
+	}
+	all.Sort()
+	expected := all.GetContacts(replicationParam)
+	found := nodes[0].LookupContact(target)
+	if len(found) != len(expected) {
+		t.Fatalf("LookupContact failed: expected %d contacts, %d returned", len(expected), len(found))
+	}
+	// A node missing from the routing tables queried can only displace the farthest ones
+	for i := range expected[:replicationParam/2] {
+		if !found[i].ID.Equals(expected[i].ID) {
+			t.Errorf("LookupContact failed: contact %d is %s, expected %s", i, found[i].ID, expected[i].ID)
+		}
+	}
+	for i := 1; i < len(found); i++ {
+		prev, c := found[i-1], found[i]
+		prev.CalcDistance(target)
+		c.CalcDistance(target)
+		if !prev.Less(&c) {
+			t.Errorf("LookupContact failed: contact %d is not closer than contact %d", i-1, i)
+		}
+	}
+}
+
+func TestLookupDataContextCancel(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	node := nodes[1]
+	// Only dead contacts closer to the hash than the live one: the lookup would wait for them
+	for _, c := range deadContactsNear(NewKademliaID(objHash), replicationParam) {
+		node.Net.RT.AddContact(c)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := node.LookupDataContext(ctx, objHash); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("LookupDataContext failed: expected deadline exceeded, %v returned", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("LookupDataContext failed: returned %s after the deadline", elapsed)
+	}
+	// The RPCs of the abandoned lookup should no longer be pending
+	deadline := time.Now().Add(time.Second)
+	for node.Net.pending.len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pending := node.Net.pending.len(); pending > 0 {
+		t.Errorf("LookupDataContext failed: %d RPCs still pending", pending)
+	}
+}
+
+func TestLookupDataContextNotFound(t *testing.T) {
+	nodes := newTestCluster(t, 5)
+	_, err := nodes[1].LookupDataContext(context.Background(), nullID)
+	var notFound *NotFoundError
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &notFound) || len(notFound.Closest) != len(nodes) {
+		t.Errorf("LookupDataContext failed: expected not found with every node, %v returned", err)
+	}
+	if _, err := nodes[1].LookupDataContext(context.Background(), "not a hash"); err == nil {
+		t.Error("LookupDataContext failed: invalid hash accepted")
+	}
+}
+
+func TestSendPingMessageContext(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	// Live node should answer
+	if err := nodes[0].Net.SendPingMessageContext(context.Background(), &nodes[1].Net.RT.me); err != nil {
+		t.Errorf("SendPingMessageContext failed: %v", err)
+	}
+	// Cancelled pings should report the cancellation as an RPCError
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dead := deadContactsNear(nodes[0].Net.RT.me.ID, 1)[0]
+	err := nodes[0].Net.SendPingMessageContext(ctx, &dead)
+	var rpcErr *RPCError
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &rpcErr) || rpcErr.Contact.Address != dead.Address {
+		t.Errorf("SendPingMessageContext failed: expected cancellation, %v returned", err)
+	}
+}
+
+func TestLookupSkipsKnownDeadContacts(t *testing.T) {
+	nodes := newTestCluster(t, 10)
+	node := nodes[1]
+	mn := node.Net.Transport.(*MemoryTransport).network
+	target := NewRandomKademliaID()
+	// The closest contacts known by the node receive the RPCs but never answer,
+	// and they already failed enough RPCs to be considered dead
+	var received int32
+	for _, c := range deadContactsNear(target, concurrencyParam) {
+		tr, err := mn.Listen(c.Address)
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		t.Cleanup(func() { tr.Close() })
+		go func() {
+			buf := make([]byte, bufferSize)
+			for {
+				if _, _, err := tr.ReadFrom(buf); err != nil {
+					return
+				}
+				atomic.AddInt32(&received, 1)
+			}
+		}()
+		node.Net.RT.AddContact(c)
+		for i := 0; i < deadContactFailures; i++ {
+			node.Net.RT.FailContact(c)
+		}
+	}
+	if found := node.LookupContact(target); len(found) == 0 {
+		t.Fatal("LookupContact failed: no contact found")
+	}
+	if n := atomic.LoadInt32(&received); n != 0 {
+		t.Errorf("LookupContact failed: %d RPCs sent to dead contacts", n)
+	}
+}
+
+// startForgingPeer runs a peer with the ID specified at the address specified, which
+// answers every FIND_VALUE RPC with forged content and the others as a node knowing nobody
+func startForgingPeer(t *testing.T, mn *MemoryNetwork, id *KademliaID, addr string) Contact {
+	return startPeer(t, mn, id, addr, func(req *message, resp *message) {
+		if req.Type == findValueRequest {
+			resp.Type, resp.Fields = valueResponse, [][]byte{[]byte("forged")}
+		}
+	})
+}
+
+// startPeer runs a peer with the ID specified at the address specified, which answers
+// every request as a node knowing nobody, once answer has changed the response
+func startPeer(t *testing.T, mn *MemoryNetwork, id *KademliaID, addr string, answer func(req *message, resp *message)) Contact {
+	tr, err := mn.Listen(addr)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	_, port, _ := splitAddr(addr)
+	go func() {
+		buf := make([]byte, bufferSize)
+		for {
+			size, from, err := tr.ReadFrom(buf)
+			if err != nil { // Closed
+				return
+			}
+			req, err := decodeMessage(buf[:size])
+			if err != nil || req.Type.isResponse() {
+				continue
+			}
+			resp := &message{Type: contactsResponse, RPCID: req.RPCID, SenderID: *id, SenderPort: uint16(port)}
+			switch req.Type {
+			case pingRequest:
+				resp.Type = pingResponse
+			case storeRequest:
+				resp.Type = storeResponse
+			}
+			answer(req, resp)
+			tr.WriteTo(resp.encode(), from)
+		}
+	}()
+	return NewContact(id, addr)
+}
+
+func TestLookupDataRejectsForgedValue(t *testing.T) {
+	nodes := newTestClusterConfig(t, 10, Config{Alpha: 1}) // One query at a time, the closest first
+	mn := nodes[0].Net.Transport.(*MemoryTransport).network
+	data := []byte("forged by the closest node")
+	hash := nodes[1].Store(data)
+	reader := nodes[len(nodes)-1]
+	reader.config.Store.Delete(hash)
+	// The forger is closer to the value than any other node
+	id := *NewKademliaID(hash)
+	id[IDLength-1] ^= 1
+	forger := startForgingPeer(t, mn, &id, "127.0.0.3:1")
+	reader.Net.RT.AddContact(forger)
+	if found, ok := reader.LookupData(hash); !ok || found != string(data) {
+		t.Fatalf("LookupData failed: %v returned instead of the value", found)
+	}
+	// The sighting of its forged response, processed after the lookup, does not add it back
+	sighting := forger
+	sighting.LastSeen = reader.config.Clock.Now()
+	reader.Net.updateRoutingTable(sighting)
+	if reader.Net.RT.hasContact(forger.ID) {
+		t.Error("LookupData failed: the forger is still in the routing table")
+	}
+}
+
+func TestLookupDataOnlyForgers(t *testing.T) {
+	mn := NewMemoryNetwork()
+	reader := newTestNode(t, mn, NewRandomKademliaID(), listenPort)
+	hash := objHash
+	var forgers []Contact
+	for i, c := range deadContactsNear(NewKademliaID(hash), 2) {
+		forgers = append(forgers, startForgingPeer(t, mn, c.ID, "127.0.0.3:"+strconv.Itoa(i+1)))
+		reader.Net.RT.AddContact(forgers[i])
+	}
+	_, err := reader.LookupDataContext(context.Background(), hash)
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) {
+		t.Fatalf("LookupDataContext returned %v instead of a NotFoundError", err)
+	}
+	for _, forger := range forgers {
+		forger.LastSeen = reader.config.Clock.Now() // Sighted by the maintainer after the lookup
+		reader.Net.updateRoutingTable(forger)
+		if reader.Net.RT.hasContact(forger.ID) {
+			t.Errorf("LookupDataContext failed: forger %s is still in the routing table", forger.Address)
+		}
+		for _, c := range notFound.Closest {
+			if c.ID.Equals(forger.ID) {
+				t.Errorf("LookupDataContext failed: forger %s among the closest contacts", forger.Address)
+			}
+		}
+	}
+}
+
+func TestLookupDataForgerUnderAnotherID(t *testing.T) {
+	mn := NewMemoryNetwork()
+	reader := newTestNode(t, mn, NewRandomKademliaID(), listenPort)
+	honest := newTestNode(t, mn, NewRandomKademliaID(), listenPort+1).Net.RT.me
+	reader.Net.RT.AddContact(honest)
+	// A peer advertises the forger under the ID of the honest node
+	forger := startForgingPeer(t, mn, NewRandomKademliaID(), "127.0.0.3:1")
+	hearsay := NewContact(honest.ID, forger.Address)
+	gossip := startPeer(t, mn, NewKademliaID(objHash), "127.0.0.4:1", func(req *message, resp *message) {
+		if req.Type == findValueRequest {
+			resp.Fields = [][]byte{encodeContact(hearsay)}
+		}
+	})
+	reader.Net.RT.AddContact(gossip)
+	if _, ok := reader.LookupData(objHash); ok {
+		t.Fatal("LookupData failed: forged value returned")
+	}
+	// The forger answered under its own ID, the honest node is neither evicted nor refused
+	if known, ok := reader.Net.RT.lookupContact(honest.ID); !ok || known.Address != honest.Address {
+		t.Fatalf("LookupData failed: the honest node was evicted (%+v)", known)
+	}
+	reader.Net.RT.RemoveContact(honest.ID)
+	honest.LastSeen = reader.config.Clock.Now()
+	if !reader.Net.RT.AddContact(honest) {
+		t.Error("LookupData failed: the honest node is refused after the lookup")
+	}
+}
+
+func TestLoadRemovesCorruptValue(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), NewRandomKademliaID(), listenPort)
+	node.config.Store.Put(objHash, []byte("corrupted on disk"), node.expiration())
+	key, _ := hex.DecodeString(objHash)
+	if typ, _ := node.handleRPC(findValueRequest, [][]byte{key}); typ != contactsResponse {
+		t.Errorf("FIND_VALUE RPC failed: %s returned for a corrupt value", typ)
+	}
+	if _, _, err := node.config.Store.Get(objHash); !errors.Is(err, ErrNotFound) {
+		t.Errorf("The corrupt value is still stored (%v)", err)
+	}
+}
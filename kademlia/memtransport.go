@@ -0,0 +1,106 @@
+package kademlia
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+const memoryInboxSize = 1024 // Datagrams queued per in-memory transport before dropping
+
+// MemoryNetwork definition
+// connects MemoryTransports living in the same process, so that many nodes
+// can be run inside a single test without touching the operating system
+type MemoryNetwork struct {
+	mu    sync.RWMutex
+	nodes map[string]*MemoryTransport
+}
+
+// NewMemoryNetwork returns a new instance of an empty MemoryNetwork
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: make(map[string]*MemoryTransport)}
+}
+
+// Listen returns a new MemoryTransport bound to the "host:port" address specified
+func (mn *MemoryNetwork) Listen(addr string) (*MemoryTransport, error) {
+	if _, _, err := splitAddr(addr); err != nil {
+		return nil, err
+	}
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	if _, ok := mn.nodes[addr]; ok {
+		return nil, fmt.Errorf("memory network: address %s already in use", addr)
+	}
+	t := &MemoryTransport{
+		network: mn,
+		addr:    addr,
+		inbox:   make(chan datagram, memoryInboxSize),
+		closed:  make(chan struct{}),
+	}
+	mn.nodes[addr] = t
+	return t, nil
+}
+
+// datagram definition
+// stores a message in flight between two MemoryTransports
+type datagram struct {
+	data []byte
+	from string
+}
+
+// MemoryTransport definition
+// implements the Transport over channels, with the same best-effort
+// semantics of UDP: datagrams to unknown addresses or full inboxes are dropped
+type MemoryTransport struct {
+	network   *MemoryNetwork
+	addr      string
+	inbox     chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// WriteTo delivers a copy of the datagram to the transport bound to addr, if any
+func (t *MemoryTransport) WriteTo(data []byte, addr string) error {
+	select {
+	case <-t.closed:
+		return net.ErrClosed
+	default:
+	}
+	t.network.mu.RLock()
+	dst, ok := t.network.nodes[addr]
+	t.network.mu.RUnlock()
+	if !ok {
+		return nil // Nobody is listening, the datagram is lost
+	}
+	select {
+	case dst.inbox <- datagram{data: append([]byte{}, data...), from: t.addr}:
+	default: // The inbox is full, the datagram is lost
+	}
+	return nil
+}
+
+// ReadFrom blocks until a datagram is delivered to the transport
+func (t *MemoryTransport) ReadFrom(buf []byte) (int, string, error) {
+	select {
+	case d := <-t.inbox:
+		return copy(buf, d.data), d.from, nil
+	case <-t.closed:
+		return 0, "", net.ErrClosed
+	}
+}
+
+// LocalAddr returns the address the transport is bound to
+func (t *MemoryTransport) LocalAddr() string {
+	return t.addr
+}
+
+// Close unbinds the transport from the MemoryNetwork
+func (t *MemoryTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.network.mu.Lock()
+		delete(t.network.nodes, t.addr)
+		t.network.mu.Unlock()
+		close(t.closed)
+	})
+	return nil
+}
@@ -0,0 +1,208 @@
+package kademlia
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const protocolVersion = 1 // Version of the wire format
+const headerSize = 1 + 1 + IDLength + IDLength + 2 + 2
+const fieldHeaderSize = 4
+const ttlSize = 8 // Time to live of the value carried by a STORE, in nanoseconds
+
+// messageType identifies the RPC carried by a message
+type messageType uint8
+
+const (
+	pingRequest messageType = iota + 1
+	storeRequest
+	findNodeRequest
+	findValueRequest
+	pingResponse
+	storeResponse
+	contactsResponse
+	valueResponse
+)
+
+var messageTypeNames = map[messageType]string{
+	pingRequest:      "PING",
+	storeRequest:     "STORE",
+	findNodeRequest:  "FIND_NODE",
+	findValueRequest: "FIND_VALUE",
+	pingResponse:     "PING_RESP",
+	storeResponse:    "STORE_RESP",
+	contactsResponse: "CONTACTS",
+	valueResponse:    "VALUE",
+}
+
+// String returns the name of the message type
+func (t messageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", uint8(t))
+}
+
+// isResponse returns true if the message type is the response to an RPC
+func (t messageType) isResponse() bool {
+	return t >= pingResponse && t <= valueResponse
+}
+
+var errShortMessage = errors.New("message too short")
+var errBadVersion = errors.New("unsupported protocol version")
+var errTrailingBytes = errors.New("trailing bytes after last field")
+
+// message definition
+// stores the header and the length-prefixed payload fields of an RPC
+//
+// Wire format (big endian):
+//
+//	version (1) | type (1) | rpc id (20) | sender id (20) | sender port (2) |
+//	field count (2) | { field length (4) | field bytes }*
+type message struct {
+	Type       messageType
+	RPCID      KademliaID
+	SenderID   KademliaID
+	SenderPort uint16
+	Fields     [][]byte
+}
+
+// encode serializes the message into its binary representation
+func (m *message) encode() []byte {
+	size := headerSize
+	for _, f := range m.Fields {
+		size += fieldHeaderSize + len(f)
+	}
+	buf := make([]byte, size)
+	buf[0] = protocolVersion
+	buf[1] = byte(m.Type)
+	copy(buf[2:], m.RPCID[:])
+	copy(buf[2+IDLength:], m.SenderID[:])
+	binary.BigEndian.PutUint16(buf[2+2*IDLength:], m.SenderPort)
+	binary.BigEndian.PutUint16(buf[4+2*IDLength:], uint16(len(m.Fields)))
+	off := headerSize
+	for _, f := range m.Fields {
+		binary.BigEndian.PutUint32(buf[off:], uint32(len(f)))
+		off += fieldHeaderSize
+		off += copy(buf[off:], f)
+	}
+	return buf
+}
+
+// decodeMessage parses a binary message, returning an error if it is malformed.
+// The returned fields do not alias buf
+func decodeMessage(buf []byte) (*message, error) {
+	if len(buf) < headerSize {
+		return nil, errShortMessage
+	}
+	if buf[0] != protocolVersion {
+		return nil, fmt.Errorf("%w: %d", errBadVersion, buf[0])
+	}
+	m := &message{Type: messageType(buf[1])}
+	copy(m.RPCID[:], buf[2:])
+	copy(m.SenderID[:], buf[2+IDLength:])
+	m.SenderPort = binary.BigEndian.Uint16(buf[2+2*IDLength:])
+	count := int(binary.BigEndian.Uint16(buf[4+2*IDLength:]))
+	off := headerSize
+	for i := 0; i < count; i++ {
+		if len(buf)-off < fieldHeaderSize {
+			return nil, errShortMessage
+		}
+		size := int(binary.BigEndian.Uint32(buf[off:]))
+		off += fieldHeaderSize
+		if size > len(buf)-off {
+			return nil, errShortMessage
+		}
+		field := make([]byte, size)
+		off += copy(field, buf[off:off+size])
+		m.Fields = append(m.Fields, field)
+	}
+	if off != len(buf) {
+		return nil, errTrailingBytes
+	}
+	return m, nil
+}
+
+// String returns a simple string representation of a message
+func (m *message) String() string {
+	var fields []string
+	for _, f := range m.Fields {
+		switch {
+		case len(f) > 64:
+			fields = append(fields, fmt.Sprintf("<%d bytes>", len(f)))
+		case isPrintable(f):
+			fields = append(fields, fmt.Sprintf("%q", f))
+		default:
+			fields = append(fields, hex.EncodeToString(f))
+		}
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s %s", m.Type, strings.Join(fields, " ")))
+}
+
+// isPrintable returns true if the bytes are a printable UTF-8 string
+func isPrintable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeTTL serializes the time to live of the value carried by a STORE. It is relative
+// to the time the STORE is sent, so that the clocks of the nodes do not need to agree
+func encodeTTL(ttl time.Duration) []byte {
+	buf := make([]byte, ttlSize)
+	binary.BigEndian.PutUint64(buf, uint64(ttl))
+	return buf
+}
+
+// decodeTTL parses a time to live encoded by encodeTTL
+func decodeTTL(buf []byte) time.Duration {
+	return time.Duration(binary.BigEndian.Uint64(buf))
+}
+
+// encodeContact serializes a contact as it is sent in the responses
+// of the FIND_NODE and FIND_VALUE RPCs: id (20) | port (2) | ip
+func encodeContact(contact Contact) []byte {
+	host, portStr, _ := net.SplitHostPort(contact.Address)
+	port, _ := strconv.Atoi(portStr)
+	buf := make([]byte, IDLength+2+len(host))
+	copy(buf, contact.ID[:])
+	binary.BigEndian.PutUint16(buf[IDLength:], uint16(port))
+	copy(buf[IDLength+2:], host)
+	return buf
+}
+
+// decodeContact parses a contact encoded by encodeContact
+func decodeContact(buf []byte) (Contact, error) {
+	if len(buf) < IDLength+2 {
+		return Contact{}, errShortMessage
+	}
+	id := KademliaID{}
+	copy(id[:], buf)
+	port := int(binary.BigEndian.Uint16(buf[IDLength:]))
+	return NewContact(&id, net.JoinHostPort(string(buf[IDLength+2:]), strconv.Itoa(port))), nil
+}
+
+// decodeContacts parses every field of a contacts response, skipping the malformed ones
+func decodeContacts(fields [][]byte) []Contact {
+	var contacts []Contact
+	for _, f := range fields {
+		if c, err := decodeContact(f); err == nil {
+			contacts = append(contacts, c)
+		}
+	}
+	return contacts
+}
@@ -0,0 +1,69 @@
+package kademlia
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	// Fields with spaces, commas, empty and binary content must survive the round trip
+	msg := &message{
+		Type:       storeRequest,
+		RPCID:      *NewKademliaID(contactID),
+		SenderID:   *NewKademliaID(objHash),
+		SenderPort: listenPort,
+		Fields:     [][]byte{[]byte("hello world, again"), {}, {0x00, 0xff, '\n', ' '}},
+	}
+	decoded, err := decodeMessage(msg.encode())
+	if err != nil {
+		t.Fatalf("decodeMessage failed: %v", err)
+	}
+	if decoded.Type != msg.Type || decoded.RPCID != msg.RPCID || decoded.SenderID != msg.SenderID ||
+		decoded.SenderPort != msg.SenderPort {
+		t.Error("decodeMessage failed: header mismatch")
+	}
+	if len(decoded.Fields) != len(msg.Fields) {
+		t.Fatalf("decodeMessage failed: expected %d fields, %d returned", len(msg.Fields), len(decoded.Fields))
+	}
+	for i := range msg.Fields {
+		if !bytes.Equal(decoded.Fields[i], msg.Fields[i]) {
+			t.Errorf("decodeMessage failed: field %d mismatch", i)
+		}
+	}
+}
+
+func TestMessageMalformed(t *testing.T) {
+	buf := (&message{Type: pingRequest, Fields: [][]byte{[]byte("payload")}}).encode()
+	// Truncated header
+	if _, err := decodeMessage(buf[:headerSize-1]); !errors.Is(err, errShortMessage) {
+		t.Error("decodeMessage failed: truncated header accepted")
+	}
+	// Truncated field
+	if _, err := decodeMessage(buf[:len(buf)-1]); !errors.Is(err, errShortMessage) {
+		t.Error("decodeMessage failed: truncated field accepted")
+	}
+	// Trailing garbage
+	if _, err := decodeMessage(append(buf, 0)); !errors.Is(err, errTrailingBytes) {
+		t.Error("decodeMessage failed: trailing bytes accepted")
+	}
+	// Unknown version
+	bad := append([]byte{}, buf...)
+	bad[0] = protocolVersion + 1
+	if _, err := decodeMessage(bad); !errors.Is(err, errBadVersion) {
+		t.Error("decodeMessage failed: unknown version accepted")
+	}
+}
+
+func TestContactRoundTrip(t *testing.T) {
+	// The full endpoint of the contact must be preserved
+	for _, addr := range []string{contactAddr, "127.0.0.1:8001", "[::1]:8002"} {
+		c, err := decodeContact(encodeContact(NewContact(NewKademliaID(contactID), addr)))
+		if err != nil || !c.ID.Equals(NewKademliaID(contactID)) || c.Address != addr {
+			t.Errorf("decodeContact failed: wrong contact returned for %s", addr)
+		}
+	}
+	if _, err := decodeContact([]byte("short")); err == nil {
+		t.Error("decodeContact failed: short contact accepted")
+	}
+}
@@ -1,134 +1,322 @@
 package kademlia
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
+	"context"
+	"errors"
 	"fmt"
 	"net"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 )
 
-const pingTimeoutSec = 3   // Timeout for the PING RPC
-const findTimeoutSec = 20  // Timeout for the FIND_NODE and FIND_VALUE RPCs
-const storeTimeoutSec = 10 // Timeout for the STORE RPC
-const bufferSize = 8192
+const handlerWorkers = 8 // Routines handling the incoming RPCs
+const queueSize = 256    // Incoming RPCs and sightings waiting to be processed
+const rpcIDAttempts = 3  // IDs tried for an RPC before giving up on collisions
 
 type Network struct {
-	RPC        sync.Map // Channel map for communicating with the service layer
 	RT         *RoutingTable
+	Transport  Transport
 	ListenIP   net.IP
 	ListenPort int
+	config     *Config            // Protocol parameters of the node
+	pending    *rpcTracker        // RPCs waiting for a response from the service layer
+	newRPCID   func() *KademliaID // Generator of the RPC transaction IDs
+	closed     chan struct{}      // Closed when the network layer is stopped
+	closeOnce  sync.Once
 }
 
-// listen accounts for incoming messages to the node communicating with
-// the service layer and responding to the RPC calls
+// Close stops the network layer: the transport is closed, which ends the listener,
+// and every pending RPC fails with ErrClosed
+func (n *Network) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		close(n.closed) // Wake up every routine waiting for a response
+		if n.Transport != nil {
+			err = n.Transport.Close()
+		}
+		n.pending.close() // Fail the pending RPCs
+	})
+	return err
+}
+
+// request definition
+// stores an incoming RPC waiting for a worker, together with its sender
+type request struct {
+	msg    *message
+	sender Contact
+}
+
+// listen accounts for incoming messages to the node. Responses are delivered to the
+// service layer right away, while RPCs are queued for the pool of handling workers and
+// senders for the routing table maintainer, so that reading is never blocked by either
 func (n *Network) listen(handler *Kademlia) {
-	addr := net.UDPAddr{ // myListenAddress
-		IP:   n.ListenIP,
-		Port: n.ListenPort,
+	requests := make(chan request, queueSize)
+	sightings := make(chan Contact, queueSize)
+	defer close(requests) // Stop the workers and the maintainer when the transport is closed
+	defer close(sightings)
+	for i := 0; i < handlerWorkers; i++ {
+		handler.spawn(func() { n.serve(handler, requests) })
 	}
-	// Announce the listen address to the local network
-	conn, _ := net.ListenUDP("udp", &addr)
-	buf := make([]byte, bufferSize)
+	handler.spawn(func() { n.maintain(handler, sightings) })
+	buf := make([]byte, n.config.BufferSize)
 	for {
-		size, addr, _ := conn.ReadFromUDP(buf) // Listen for incoming messages
-		h := sha1.New()
-		h.Write(addr.IP.To4())
-		msg := string(buf[:size])       // Obtain the plain text string message
-		cmdLine := strings.Fields(msg)  // Divide its fields
-		id := NewKademliaID(cmdLine[0]) // ID of the RPC
-		fmt.Printf("%s -> %s\n", addr.IP, msg[41:])
-		// Create a new contact from the sender's address
-		contact := NewContact(NewKademliaID(hex.EncodeToString(h.Sum(nil))), addr.IP.String())
-		if n.updateRoutingTable(contact) { // If the routing table is updated
-			// Update the storage by sending the appropriate values to the new known node
-			handler.updateStorage(contact)
+		size, from, err := n.Transport.ReadFrom(buf) // Listen for incoming messages
+		if errors.Is(err, net.ErrClosed) {           // The transport has been closed
+			return
+		}
+		if err != nil {
+			continue
 		}
-		if ch, ok := n.RPC.Load(*id); ok { // If we receive a response
-			ch.(chan []string) <- cmdLine[1:] // Send it to the service layer
-			close(ch.(chan []string))         // Close the channel
+		ip, _, err := splitAddr(from) // Obtain the sender's address
+		if err != nil {
+			continue
+		}
+		msg, err := decodeMessage(buf[:size]) // Decode the binary message
+		if err != nil {                       // Drop malformed messages
+			fmt.Printf("%s -> malformed message: %v\n", ip, err)
+			continue
+		}
+		fmt.Printf("%s -> %s\n", ip, msg)
+		// Create a new contact from the ID declared by the sender, its address and the port it listens on
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(msg.SenderPort)))
+		senderID := msg.SenderID
+		contact := NewContact(&senderID, addr)
+		contact.LastSeen = n.config.Clock.Now()
+		if rtt, ok := n.pending.rtt(msg, from); ok && msg.Type.isResponse() { // If it answers one of our RPCs
+			contact.LastReplied, contact.RTT = contact.LastSeen, rtt
+		}
+		if !contact.ID.Equals(n.RT.me.ID) { // A node never adds itself to the routing table
+			select {
+			case sightings <- contact: // Let the maintainer update the routing table
+			default: // The maintainer is busy, skip this sighting
+			}
+		}
+		if msg.Type.isResponse() { // If we receive a response
+			// Send it to the service layer, if it is the one we are waiting for
+			if !n.pending.deliver(msg, from) {
+				fmt.Printf("%s -> unexpected %s discarded\n", ip, msg.Type)
+			}
 			continue
 		}
 		// If it's not a response, it's an RPC
-		cmd := cmdLine[1] // RPC type
-		var args []string
-		if len(cmdLine) > 2 {
-			args = cmdLine[2:]
+		select {
+		case requests <- request{msg: msg, sender: contact}: // Queue it for the workers
+		default: // The workers are overloaded, drop it as the network would
+			fmt.Printf("%s -> dropped %s\n", ip, msg.Type)
 		}
+	}
+}
+
+// serve handles the RPCs received through the requests channel and sends
+// the generated responses back, until the channel is closed
+func (n *Network) serve(handler *Kademlia, requests <-chan request) {
+	for req := range requests {
 		// Call for the handling of the RPC
-		resp := handler.handleRPC(cmd, args)
-		addr.Port = n.ListenPort
-		conn, _ := net.DialUDP("udp", nil, addr)
-		msg = fmt.Sprintf("%s %s", id, resp) // Create the message
-		fmt.Fprintf(conn, msg)               // Send the response back
-		fmt.Printf("%s -> %s\n", msg[41:], addr.IP)
-		conn.Close()
-	}
-}
-
-// sendRPC sends the request message to the contact specified
-// in the parameters
-func (n *Network) sendRPC(recipient *Contact, request string) *KademliaID {
-	addr := net.UDPAddr{
-		IP:   net.ParseIP(recipient.Address),
-		Port: n.ListenPort,
-	}
-	id := NewRandomKademliaID() // Generate an ID for the RPC
-	// Store a channel for sending the response to the service layer
-	n.RPC.Store(*id, make(chan []string, 10))
-	msg := fmt.Sprintf("%s %s", id, request) // Create the message
-	conn, _ := net.DialUDP("udp", nil, &addr)
-	fmt.Fprintf(conn, msg) // Send the message
-	fmt.Printf("%s -> %s\n", msg[41:], recipient.Address)
-	conn.Close()
-	return id
+		respType, fields := handler.handleRPC(req.msg.Type, req.msg.Fields)
+		if respType == 0 { // Unknown RPCs are not answered
+			continue
+		}
+		resp := n.newMessage(respType, req.msg.RPCID, fields)  // Create the message
+		n.Transport.WriteTo(resp.encode(), req.sender.Address) // Send the response back
+		fmt.Printf("%s -> %s\n", resp, req.sender.Address)
+	}
+}
+
+// maintain updates the routing table with the contacts received through the
+// sightings channel, until the channel is closed. Since it runs apart from the
+// listener, the responses to the pings it sends can be received while it waits
+func (n *Network) maintain(handler *Kademlia, sightings <-chan Contact) {
+	for contact := range sightings {
+		if n.updateRoutingTable(contact) { // If the routing table is updated
+			// Update the storage by sending the appropriate values to the new known node
+			handler.updateStorage(contact)
+		}
+		// Now that another node is reachable, the values published before a restart can reach it
+		handler.resume.Do(handler.resumeRepublishing)
+	}
+}
+
+// newMessage creates a message with the header filled with the information of this node
+func (n *Network) newMessage(typ messageType, id KademliaID, fields [][]byte) *message {
+	return &message{
+		Type:       typ,
+		RPCID:      id,
+		SenderID:   *n.RT.me.ID,
+		SenderPort: uint16(n.ListenPort),
+		Fields:     fields,
+	}
+}
+
+// rpcTimeout returns the time a node has for responding to the RPC type specified
+func (n *Network) rpcTimeout(typ messageType) time.Duration {
+	switch typ {
+	case pingRequest:
+		return n.config.PingTimeout
+	case storeRequest:
+		return n.config.StoreTimeout
+	}
+	return n.config.FindTimeout
+}
+
+// sendRPC sends the request message to the contact specified in the parameters and
+// returns its ID together with the channel its response will be delivered to. The
+// channel is closed without a response if the RPC times out or the node is closed
+func (n *Network) sendRPC(recipient *Contact, typ messageType, fields ...[]byte) (*KademliaID, <-chan *message, error) {
+	var id *KademliaID
+	var ch <-chan *message
+	err := errDuplicateRPC
+	for i := 0; i < rpcIDAttempts && errors.Is(err, errDuplicateRPC); i++ {
+		id = n.newRPCID() // Generate an unpredictable ID for the RPC
+		// Register the RPC for receiving its response, unless the ID is already pending
+		ch, err = n.pending.add(*id, recipient.Address, n.rpcTimeout(typ))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := n.newMessage(typ, *id, fields)                                        // Create the message
+	if err := n.Transport.WriteTo(msg.encode(), recipient.Address); err != nil { // Send the message
+		n.pending.cancel(*id)
+		return nil, nil, err
+	}
+	fmt.Printf("%s -> %s\n", msg, recipient.Address)
+	return id, ch, nil
+}
+
+// failure returns the reason why a pending RPC ended without a response
+func (n *Network) failure() error {
+	select {
+	case <-n.closed:
+		return ErrClosed
+	default:
+		return ErrTimeout
+	}
+}
+
+// call sends the request message to the recipient and waits for its response
+// until the RPC times out or the context is done, whichever happens first
+func (n *Network) call(ctx context.Context, recipient *Contact, typ messageType, fields ...[]byte) (*message, error) {
+	id, ch, err := n.sendRPC(recipient, typ, fields...)
+	if err != nil {
+		return nil, &RPCError{RPC: typ.String(), Contact: *recipient, Err: err}
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok { // If the node does not respond
+			err := n.failure()
+			n.failed(recipient, err)
+			return nil, &RPCError{RPC: typ.String(), Contact: *recipient, Err: err}
+		}
+		return resp, nil
+	case <-ctx.Done(): // If the caller is no longer interested
+		n.pending.cancel(*id) // Stop waiting for the response
+		return nil, &RPCError{RPC: typ.String(), Contact: *recipient, Err: ctx.Err()}
+	}
+}
+
+// failed records in the routing table that the contact did not answer an RPC,
+// unless the RPC failed because of the closing of the node
+func (n *Network) failed(contact *Contact, err error) {
+	if errors.Is(err, ErrTimeout) {
+		n.RT.FailContact(*contact)
+	}
 }
 
 // updateRoutingTable updates the necessary k-bucket of the routing table
 // with the contact received as a parameter. It returns true if the table is
 // updated and false otherwise
 func (n *Network) updateRoutingTable(contact Contact) bool {
-	// Obtain the k-bucket associated with the contact's ID
-	bucket := n.RT.buckets[n.RT.getBucketIndex(contact.ID)]
-	if bucket.Len() < bucketSize { // If the k-bucket is not full
-		return n.RT.AddContact(contact) // The contact is added
-	}
-	// If not obtain the LeastRecentlySeen contact of the k-bucket
-	lrs := bucket.list.Back().Value.(Contact)
-	ch, _ := n.RPC.Load(*n.SendPingMessage(&lrs)) // We check its availability
-	select {
-	case <-ch.(chan []string): // If the LeastRecentlySeen node responds
-		// Move it to the front of the list
-		bucket.list.MoveToFront(bucket.list.Back())
+	// Add the contact, or obtain the LeastRecentlySeen contact if its k-bucket is full
+	added, lrs := n.RT.tryAddContact(contact)
+	if lrs == nil { // Added now, or refreshed if it already existed
+		return added
+	}
+	err := ErrTimeout // A LeastRecentlySeen node known to be dead is not even pinged
+	if !lrs.dead() {
+		_, err = n.call(context.Background(), lrs, pingRequest) // We check its availability
+	}
+	switch {
+	case err == nil: // If the LeastRecentlySeen node responds
+		n.RT.AddContact(*lrs) // Move it to the front of the list
 		return false
-	case <-time.After(pingTimeoutSec * time.Second): // If the LeastRecentlySeen node does not respond
-		bucket.list.Remove(bucket.list.Back()) // Remove it from the k-bucket
-		bucket.list.PushFront(contact)         // Add the new contact
-		return true
+	case errors.Is(err, ErrClosed): // If the node is closed
+		return false
+	default: // If the LeastRecentlySeen node does not respond
+		n.RT.RemoveContact(lrs.ID) // Replace it with the most recently seen contact in the cache
+		return n.RT.hasContact(contact.ID)
 	}
 }
 
-// SendPingMessage sends a PING RPC to the recipient specified
+// SendPingMessage sends a PING RPC to the recipient specified without waiting
+// for its response. It returns the ID of the RPC, or nil if it could not be sent
 func (n *Network) SendPingMessage(recipient *Contact) *KademliaID {
-	return n.sendRPC(recipient, "PING")
+	id, _, _ := n.sendRPC(recipient, pingRequest)
+	return id
 }
 
-// SendFindContactMessage sends a FIND_NODE RPC for the target to the recipient specified
+// SendFindContactMessage sends a FIND_NODE RPC for the target to the recipient specified without
+// waiting for its response. It returns the ID of the RPC, or nil if it could not be sent
 func (n *Network) SendFindContactMessage(target *KademliaID, recipient *Contact) *KademliaID {
-	req := fmt.Sprintf("FIND_NODE %s", target)
-	return n.sendRPC(recipient, req)
+	id, _, _ := n.sendRPC(recipient, findNodeRequest, target[:])
+	return id
 }
 
-// SendFindDataMessage sends a FIND_VALUE RPC for the hash to the recipient specified
+// SendFindDataMessage sends a FIND_VALUE RPC for the hash to the recipient specified without
+// waiting for its response. It returns the ID of the RPC, or nil if it could not be sent
 func (n *Network) SendFindDataMessage(hash string, recipient *Contact) *KademliaID {
-	req := fmt.Sprintf("FIND_VALUE %s", hash)
-	return n.sendRPC(recipient, req)
+	id, _, _ := n.sendRPC(recipient, findValueRequest, NewKademliaID(hash)[:])
+	return id
+}
+
+// SendStoreMessage sends a STORE RPC for the data, left to live for the time specified, to the
+// recipient specified without waiting for its response. A zero time to live publishes the data,
+// which then lives for the expiration delay of the recipient. It returns the ID of the RPC, or
+// nil if it could not be sent
+func (n *Network) SendStoreMessage(data []byte, ttl time.Duration, recipient *Contact) *KademliaID {
+	id, _, _ := n.sendRPC(recipient, storeRequest, storeFields(data, ttl)...)
+	return id
 }
 
-// SendStoreMessage sends a STORE RPC for the data to the recipient specified
-func (n *Network) SendStoreMessage(data []byte, recipient *Contact) *KademliaID {
-	req := fmt.Sprintf("STORE %s", data)
-	return n.sendRPC(recipient, req)
+// SendPingMessageContext sends a PING RPC to the recipient specified and waits for its response
+func (n *Network) SendPingMessageContext(ctx context.Context, recipient *Contact) error {
+	_, err := n.call(ctx, recipient, pingRequest)
+	return err
+}
+
+// SendFindContactMessageContext sends a FIND_NODE RPC for the target to the recipient
+// specified and returns the contacts of its response
+func (n *Network) SendFindContactMessageContext(ctx context.Context, target *KademliaID, recipient *Contact) ([]Contact, error) {
+	resp, err := n.call(ctx, recipient, findNodeRequest, target[:])
+	if err != nil {
+		return nil, err
+	}
+	return decodeContacts(resp.Fields), nil
+}
+
+// SendFindDataMessageContext sends a FIND_VALUE RPC for the hash to the recipient specified and
+// returns the value of its response, or the contacts of its response if it does not hold the value
+func (n *Network) SendFindDataMessageContext(ctx context.Context, hash string, recipient *Contact) ([]byte, []Contact, error) {
+	resp, err := n.call(ctx, recipient, findValueRequest, NewKademliaID(hash)[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Type == valueResponse && len(resp.Fields) == 1 {
+		return resp.Fields[0], nil, nil
+	}
+	return nil, decodeContacts(resp.Fields), nil
+}
+
+// SendStoreMessageContext sends a STORE RPC for the data, left to live as SendStoreMessage
+// describes, to the recipient specified and waits for its response
+func (n *Network) SendStoreMessageContext(ctx context.Context, data []byte, ttl time.Duration, recipient *Contact) error {
+	_, err := n.call(ctx, recipient, storeRequest, storeFields(data, ttl)...)
+	return err
+}
+
+// storeFields returns the fields of a STORE RPC for the data, left to live for the time specified
+func storeFields(data []byte, ttl time.Duration) [][]byte {
+	if ttl == 0 { // A publication
+		return [][]byte{data}
+	}
+	return [][]byte{data, encodeTTL(ttl)}
 }
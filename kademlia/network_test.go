@@ -0,0 +1,119 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// idInFirstBucket returns an ID that differs from the null ID in the first bit
+func idInFirstBucket(suffix byte) *KademliaID {
+	id := KademliaID{0x80}
+	id[IDLength-1] = suffix
+	return &id
+}
+
+func TestFullBucketKeepsLiveContact(t *testing.T) {
+	mn := NewMemoryNetwork()
+	node := newTestNode(t, mn, NewKademliaID(nullID), listenPort)
+	live := newTestNode(t, mn, idInFirstBucket(0), listenPort+1)
+	// Fill the first bucket, with the live contact as the least recently seen
+	node.Net.RT.AddContact(live.Net.RT.me)
+	for i := 1; i < bucketSize; i++ {
+		node.Net.RT.AddContact(NewContact(idInFirstBucket(byte(i)), net.JoinHostPort("127.0.0.2", strconv.Itoa(i))))
+	}
+	bucket := node.Net.RT.bucketContacts(0)
+	if len(bucket) != bucketSize || !bucket[len(bucket)-1].ID.Equals(live.Net.RT.me.ID) {
+		t.Fatal("AddContact failed: bucket not filled as expected")
+	}
+	// A new contact for the full bucket shows up: the live contact is pinged, and
+	// its response must be received even if the new contact keeps talking to the node
+	newcomer := newTestNode(t, mn, idInFirstBucket(0xff), listenPort+2)
+	for i := 0; i < 3; i++ {
+		if err := newcomer.Net.SendPingMessageContext(context.Background(), &node.Net.RT.me); err != nil {
+			t.Fatalf("SendPingMessageContext failed: %v", err)
+		}
+	}
+	// The live contact answers well before the ping timeout and is moved to the front
+	deadline := time.Now().Add(pingTimeoutSec * time.Second / 2)
+	for !node.Net.RT.bucketContacts(0)[0].ID.Equals(live.Net.RT.me.ID) {
+		if time.Now().After(deadline) {
+			t.Fatal("updateRoutingTable failed: live contact not refreshed in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if node.Net.RT.hasContact(newcomer.Net.RT.me.ID) {
+		t.Error("updateRoutingTable failed: live contact evicted for the newcomer")
+	}
+	// The newcomer is kept aside for when a contact of the bucket fails
+	cache := node.Net.RT.Buckets()[0].Replacements
+	if len(cache) != 1 || !cache[0].ID.Equals(newcomer.Net.RT.me.ID) {
+		t.Errorf("updateRoutingTable failed: newcomer not in the replacement cache: %v", cache)
+	}
+}
+
+func TestSendRPCAvoidsPendingIDs(t *testing.T) {
+	// A node without background routines, sending to a bare transport
+	mn := NewMemoryNetwork()
+	node, err := NewKademlia(NewContact(NewRandomKademliaID(), "127.0.0.1:1"), Config{})
+	if err != nil {
+		t.Fatalf("NewKademlia failed: %v", err)
+	}
+	n := &node.Net
+	n.Transport, _ = mn.Listen("127.0.0.1:1")
+	peer, _ := mn.Listen("127.0.0.1:2")
+	defer n.Close()
+	defer peer.Close()
+	recipient := NewContact(NewRandomKademliaID(), peer.LocalAddr())
+	// The generator returns an ID that is already pending before a fresh one
+	taken := *NewRandomKademliaID()
+	n.pending.add(taken, peerAddr, time.Second)
+	fresh := NewRandomKademliaID()
+	ids := []*KademliaID{&taken, fresh}
+	n.newRPCID = func() *KademliaID {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}
+	id, _, err := n.sendRPC(&recipient, pingRequest)
+	if err != nil || !id.Equals(fresh) {
+		t.Fatalf("sendRPC failed: expected ID %s, %s returned (%v)", fresh, id, err)
+	}
+	buf := make([]byte, bufferSize)
+	size, _, _ := peer.ReadFrom(buf)
+	if msg, err := decodeMessage(buf[:size]); err != nil || msg.RPCID != *fresh {
+		t.Errorf("sendRPC failed: the request sent does not carry ID %s (%v)", fresh, err)
+	}
+	// If every attempt collides, the RPC is not sent
+	n.newRPCID = func() *KademliaID { return &taken }
+	if _, _, err := n.sendRPC(&recipient, pingRequest); !errors.Is(err, errDuplicateRPC) {
+		t.Errorf("sendRPC failed: expected duplicate error, %v returned", err)
+	}
+}
+
+func TestContactLivenessRecorded(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	peer := nodes[1].Net.RT.me
+	start := time.Now()
+	if err := nodes[0].Net.SendPingMessageContext(context.Background(), &peer); err != nil {
+		t.Fatalf("SendPingMessageContext failed: %v", err)
+	}
+	// The routing table is updated by the maintainer, shortly after the response
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, ok := nodes[0].Net.RT.lookupContact(peer.ID)
+		if ok && c.LastReplied.After(start) {
+			if c.RTT <= 0 || c.LastSeen.Before(c.LastReplied) || c.Failures != 0 {
+				t.Errorf("updateRoutingTable failed: unexpected metadata %+v", c)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("updateRoutingTable failed: reply not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,306 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const manifestMagic = "\x00KDM"                                  // Start of a manifest, which no text value has
+const manifestHeaderSize = len(manifestMagic) + 1 + 8 + IDLength // Magic, depth, size and root hash
+const manifestMaxDepth = 8                                       // Levels of manifests beyond which one is considered corrupt
+const objectConcurrency = 8                                      // Chunks stored or fetched at the same time for an object
+
+// ErrCorruptObject is returned when the chunks of a large object do not match its manifest
+var ErrCorruptObject = errors.New("kademlia: object does not match its manifest")
+
+// manifest definition
+// describes a large object, or a part of it, split into chunks stored under their own
+// keys. A manifest of depth 0 lists the keys of the chunks, one of a higher depth the
+// keys of the manifests of the next depth, each covering a consecutive part of the
+// object. Every manifest carries the root hash, the SHA1 of the whole object
+//
+// Format (big endian):
+//
+//	magic (4) | depth (1) | size of the part (8) | root hash (20) | { key (20) }*
+type manifest struct {
+	depth   uint8
+	size    uint64
+	root    KademliaID
+	entries []KademliaID
+}
+
+// encode returns the manifest as stored in the network
+func (m *manifest) encode() []byte {
+	data := make([]byte, manifestHeaderSize, manifestHeaderSize+len(m.entries)*IDLength)
+	copy(data, manifestMagic)
+	data[len(manifestMagic)] = m.depth
+	binary.BigEndian.PutUint64(data[len(manifestMagic)+1:], m.size)
+	copy(data[len(manifestMagic)+9:], m.root[:])
+	for _, entry := range m.entries {
+		data = append(data, entry[:]...)
+	}
+	return data
+}
+
+// decodeManifest returns the manifest encoded in the data, and false if the data is not one
+func decodeManifest(data []byte) (*manifest, bool) {
+	if !bytes.HasPrefix(data, []byte(manifestMagic)) || len(data) < manifestHeaderSize+IDLength ||
+		(len(data)-manifestHeaderSize)%IDLength != 0 || data[len(manifestMagic)] > manifestMaxDepth {
+		return nil, false
+	}
+	m := &manifest{
+		depth: data[len(manifestMagic)],
+		size:  binary.BigEndian.Uint64(data[len(manifestMagic)+1:]),
+	}
+	copy(m.root[:], data[len(manifestMagic)+9:])
+	for entry := data[manifestHeaderSize:]; len(entry) > 0; entry = entry[IDLength:] {
+		var key KademliaID
+		copy(key[:], entry)
+		m.entries = append(m.entries, key)
+	}
+	return m, true
+}
+
+// StoreObject stores the object read from r, which can be of any size, and returns its key.
+// An object that fits in a chunk is stored as a single value under its SHA1, as Store does.
+// A larger one is split into chunks stored under their own SHA1, listed by a manifest whose
+// key is returned, so that LookupData reassembles the object from the key
+func (k *Kademlia) StoreObject(r io.Reader) (string, error) {
+	return k.StoreObjectContext(context.Background(), r)
+}
+
+// StoreObjectContext is like StoreObject but gives up as soon as the context is done.
+// It returns an error if any chunk or manifest could not be stored
+func (k *Kademlia) StoreObjectContext(ctx context.Context, r io.Reader) (string, error) {
+	chunkSize := k.config.ChunkSize
+	first := make([]byte, chunkSize+1)
+	n, err := io.ReadFull(r, first)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	// A small object is stored as is, unless it could be mistaken for a manifest
+	if n <= chunkSize && !bytes.HasPrefix(first[:n], []byte(manifestMagic)) {
+		return k.StoreContext(ctx, first[:n])
+	}
+	r = io.MultiReader(bytes.NewReader(first[:n]), r)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := &objectStorer{k: k, ctx: ctx, cancel: cancel, sem: make(chan struct{}, objectConcurrency)}
+	root := sha1.New()
+	var keys []KademliaID // Of the entries of the level of the tree being built
+	var sizes []uint64    // Of the parts of the object covered by the entries
+	for {
+		chunk := make([]byte, chunkSize)
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			root.Write(chunk[:n])
+			keys = append(keys, s.store(chunk[:n]))
+			sizes = append(sizes, uint64(n))
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			cancel()
+			s.wait()
+			return "", err
+		}
+	}
+	m := manifest{size: sum(sizes)}
+	copy(m.root[:], root.Sum(nil))
+	perManifest := (chunkSize - manifestHeaderSize) / IDLength
+	for len(keys) > perManifest { // Add a level of manifests until the top one lists every entry
+		var parentKeys []KademliaID
+		var parentSizes []uint64
+		for i := 0; i < len(keys); i += perManifest {
+			end := i + perManifest
+			if end > len(keys) {
+				end = len(keys)
+			}
+			part := manifest{depth: m.depth, size: sum(sizes[i:end]), root: m.root, entries: keys[i:end]}
+			parentKeys = append(parentKeys, s.storeManifest(&part))
+			parentSizes = append(parentSizes, part.size)
+		}
+		keys, sizes = parentKeys, parentSizes
+		m.depth++
+	}
+	m.entries = keys
+	key := s.storeManifest(&m)
+	return key.String(), s.wait()
+}
+
+// objectStorer definition
+// stores the chunks and the manifests of a large object in the background,
+// up to objectConcurrency at a time, and remembers the first failure
+type objectStorer struct {
+	k      *Kademlia
+	ctx    context.Context
+	cancel context.CancelFunc
+	sem    chan struct{}
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+}
+
+// store starts storing the data and returns its key
+func (s *objectStorer) store(data []byte) KademliaID {
+	key := KademliaID(sha1.Sum(data))
+	select {
+	case s.sem <- struct{}{}:
+	case <-s.ctx.Done(): // Already failed, the key does not matter
+		return key
+	}
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			<-s.sem
+			s.wg.Done()
+		}()
+		if _, err := s.k.StoreContext(s.ctx, data); err != nil {
+			s.fail(err)
+		}
+	}()
+	return key
+}
+
+// storeManifest starts storing the manifest, remembering the parts it lists so
+// that forgetting the object forgets them too, and returns its key
+func (s *objectStorer) storeManifest(m *manifest) KademliaID {
+	key := s.store(m.encode())
+	s.k.parts.Store(key.String(), m.entries)
+	return key
+}
+
+// fail records the first error and stops the other stores
+func (s *objectStorer) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+		s.cancel()
+	}
+}
+
+// wait waits for every store started and returns the first error, if any
+func (s *objectStorer) wait() error {
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		return s.ctx.Err()
+	}
+	return s.err
+}
+
+// LookupObject writes the object associated with the hash to w, reassembling it
+// if the hash is the key of a manifest. The chunks are fetched in parallel and
+// written in order as soon as they are verified against their keys
+func (k *Kademlia) LookupObject(hash string, w io.Writer) error {
+	return k.LookupObjectContext(context.Background(), hash, w)
+}
+
+// LookupObjectContext is like LookupObject but gives up as soon as the context is done.
+// Nothing is written to w if the object is not found, the returned error is then a
+// *NotFoundError. An error wrapping ErrCorruptObject is returned if the chunks do not
+// match the manifest, in which case part of the object may have been written already
+func (k *Kademlia) LookupObjectContext(ctx context.Context, hash string, w io.Writer) error {
+	data, err := k.findValue(ctx, hash)
+	if err != nil {
+		return err
+	}
+	m, ok := decodeManifest(data)
+	if !ok {
+		_, err := w.Write(data)
+		return err
+	}
+	root := sha1.New()
+	if err := k.fetchObject(ctx, m, io.MultiWriter(w, root)); err != nil {
+		return err
+	}
+	if !bytes.Equal(root.Sum(nil), m.root[:]) {
+		return fmt.Errorf("%w: root hash of %s", ErrCorruptObject, hash)
+	}
+	return nil
+}
+
+// fetchObject writes the part of the object described by the manifest to w
+func (k *Kademlia) fetchObject(ctx context.Context, m *manifest, w io.Writer) error {
+	var written uint64
+	err := k.fetchInOrder(ctx, m.entries, func(data []byte) error {
+		if m.depth == 0 {
+			written += uint64(len(data))
+			_, err := w.Write(data)
+			return err
+		}
+		part, ok := decodeManifest(data)
+		if !ok || part.depth != m.depth-1 || part.root != m.root {
+			return fmt.Errorf("%w: bad manifest at depth %d", ErrCorruptObject, m.depth-1)
+		}
+		written += part.size
+		return k.fetchObject(ctx, part, w)
+	})
+	if err == nil && written != m.size {
+		err = fmt.Errorf("%w: %d bytes instead of %d", ErrCorruptObject, written, m.size)
+	}
+	return err
+}
+
+// fetchInOrder looks up the values under the keys, up to objectConcurrency at a time, and
+// passes them to f in the order of the keys, stopping at the first error
+func (k *Kademlia) fetchInOrder(ctx context.Context, keys []KademliaID, f func(data []byte) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make([]chan result, len(keys))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	sem := make(chan struct{}, objectConcurrency) // Values fetched and not passed to f yet
+	go func() {
+		for i := range keys {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int) {
+				data, err := k.findValue(ctx, keys[i].String()) // Verified against the key
+				results[i] <- result{data: data, err: err}
+			}(i)
+		}
+	}()
+	for i := range keys {
+		var r result
+		select {
+		case r = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		<-sem
+		if r.err != nil {
+			return r.err
+		}
+		if err := f(r.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sum returns the sum of the sizes
+func sum(sizes []uint64) uint64 {
+	var total uint64
+	for _, size := range sizes {
+		total += size
+	}
+	return total
+}
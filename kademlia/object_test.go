@@ -0,0 +1,124 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// testChunkSize lets a manifest list 4 parts, so that small objects build a tree of manifests
+const testChunkSize = manifestHeaderSize + 4*IDLength
+
+// randomObject returns an object of the size specified with random content
+func randomObject(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	m := manifest{depth: 2, size: 1 << 40, root: *NewRandomKademliaID()}
+	for i := 0; i < 3; i++ {
+		m.entries = append(m.entries, *NewRandomKademliaID())
+	}
+	decoded, ok := decodeManifest(m.encode())
+	if !ok || decoded.depth != m.depth || decoded.size != m.size || decoded.root != m.root || len(decoded.entries) != 3 || decoded.entries[2] != m.entries[2] {
+		t.Errorf("decodeManifest failed: %+v decoded as %+v", m, decoded)
+	}
+	data := m.encode()
+	for name, bad := range map[string][]byte{
+		"text":       []byte(objContent),
+		"no entries": data[:manifestHeaderSize],
+		"torn entry": data[:len(data)-1],
+		"too deep":   append(append([]byte(manifestMagic), manifestMaxDepth+1), data[len(manifestMagic)+1:]...),
+	} {
+		if _, ok := decodeManifest(bad); ok {
+			t.Errorf("decodeManifest failed: %s decoded", name)
+		}
+	}
+}
+
+func TestStoreObject(t *testing.T) {
+	nodes := newTestClusterConfig(t, 4, Config{ChunkSize: testChunkSize})
+	for name, object := range map[string][]byte{
+		"empty":       {},
+		"one chunk":   randomObject(testChunkSize),
+		"two chunks":  randomObject(testChunkSize + 1),
+		"one level":   randomObject(4 * testChunkSize),
+		"many levels": randomObject(100*testChunkSize + 7),
+		"manifest":    []byte(manifestMagic + "looks like a manifest"),
+	} {
+		hash, err := nodes[0].StoreObjectContext(context.Background(), bytes.NewReader(object))
+		if err != nil {
+			t.Fatalf("%s: StoreObjectContext failed: %v", name, err)
+		}
+		sum := sha1.Sum(object)
+		if small := len(object) <= testChunkSize && !bytes.HasPrefix(object, []byte(manifestMagic)); small != (hash == hex.EncodeToString(sum[:])) {
+			t.Errorf("%s: StoreObjectContext returned %s for an object whose SHA1 is %x", name, hash, sum)
+		}
+		data, err := nodes[3].LookupDataContext(context.Background(), hash)
+		if err != nil || !bytes.Equal(data, object) {
+			t.Errorf("%s: LookupDataContext failed: %d bytes instead of %d (%v)", name, len(data), len(object), err)
+		}
+		var buf bytes.Buffer
+		if err := nodes[2].LookupObjectContext(context.Background(), hash, &buf); err != nil || !bytes.Equal(buf.Bytes(), object) {
+			t.Errorf("%s: LookupObjectContext failed: %d bytes instead of %d (%v)", name, buf.Len(), len(object), err)
+		}
+	}
+}
+
+func TestLookupObjectCorrupt(t *testing.T) {
+	nodes := newTestClusterConfig(t, 3, Config{ChunkSize: testChunkSize})
+	object := randomObject(3 * testChunkSize)
+	hash, err := nodes[0].StoreObjectContext(context.Background(), bytes.NewReader(object))
+	if err != nil {
+		t.Fatalf("StoreObjectContext failed: %v", err)
+	}
+	data, _, _ := nodes[0].config.Store.Get(hash)
+	m, _ := decodeManifest(data)
+	// A manifest stored under its own SHA1 but not matching the object it lists
+	forged := *m
+	forged.size++
+	forgedHash := nodes[0].Store(forged.encode())
+	var buf bytes.Buffer
+	if err := nodes[1].LookupObjectContext(context.Background(), forgedHash, &buf); !errors.Is(err, ErrCorruptObject) {
+		t.Errorf("LookupObjectContext returned %v instead of ErrCorruptObject", err)
+	}
+	// Replace the second chunk with other content on every node
+	chunk := m.entries[1].String()
+	for _, node := range nodes {
+		node.config.Store.Put(chunk, []byte("forged"), node.expiration())
+	}
+	buf.Reset()
+	if err := nodes[1].LookupObjectContext(context.Background(), hash, &buf); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LookupObjectContext returned %v instead of ErrNotFound", err)
+	}
+	if !bytes.Equal(buf.Bytes(), object[:testChunkSize]) {
+		t.Errorf("LookupObjectContext wrote %d bytes instead of the first chunk", buf.Len())
+	}
+	// A missing object writes nothing
+	buf.Reset()
+	if err := nodes[1].LookupObjectContext(context.Background(), NewRandomKademliaID().String(), &buf); !errors.Is(err, ErrNotFound) || buf.Len() != 0 {
+		t.Errorf("LookupObjectContext returned %v and wrote %d bytes for a missing object", err, buf.Len())
+	}
+}
+
+func TestForgetObject(t *testing.T) {
+	nodes := newTestClusterConfig(t, 2, Config{ChunkSize: testChunkSize})
+	hash, err := nodes[0].StoreObjectContext(context.Background(), bytes.NewReader(randomObject(20*testChunkSize)))
+	if err != nil {
+		t.Fatalf("StoreObjectContext failed: %v", err)
+	}
+	if !nodes[0].ForgetData(hash) {
+		t.Fatal("ForgetData failed: the object is unknown")
+	}
+	// The chunks and the manifests below the top one are forgotten with it
+	nodes[0].forgetTable.Range(func(key, _ interface{}) bool {
+		t.Errorf("ForgetData failed: %s is still republished", key)
+		return true
+	})
+}
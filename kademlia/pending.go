@@ -0,0 +1,142 @@
+package kademlia
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxPendingRPCs = 4096 // Maximum number of RPCs waiting for a response at the same time
+
+var errDuplicateRPC = errors.New("kademlia: RPC ID already pending")
+
+// pendingRPC definition
+// stores an RPC waiting for its response
+type pendingRPC struct {
+	addr  string        // Normalized address the request was sent to
+	resp  chan *message // Receives the response, closed when the RPC is over
+	timer *time.Timer   // Removes the RPC when its deadline expires
+	sent  time.Time     // Time the request was sent at, for the round-trip time
+}
+
+// rpcTracker definition
+// keeps track of the RPCs waiting for a response. Every RPC is removed when its
+// response arrives, when its deadline expires or when it is cancelled, whichever
+// happens first, so that late and duplicate responses are discarded
+type rpcTracker struct {
+	mu      sync.Mutex
+	pending map[KademliaID]*pendingRPC
+	max     int
+	closed  bool
+}
+
+// newRPCTracker returns a new instance of an rpcTracker accepting up to max pending RPCs
+func newRPCTracker(max int) *rpcTracker {
+	return &rpcTracker{pending: make(map[KademliaID]*pendingRPC), max: max}
+}
+
+// add registers the RPC with the ID specified, sent to addr, and returns the channel its
+// response will be delivered to. The channel is closed without a response if the RPC is
+// not answered within the timeout, is cancelled, or the tracker is closed
+func (t *rpcTracker) add(id KademliaID, addr string, timeout time.Duration) (<-chan *message, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.closed:
+		return nil, ErrClosed
+	case t.pending[id] != nil:
+		return nil, errDuplicateRPC
+	case len(t.pending) >= t.max:
+		return nil, ErrTooManyRPCs
+	}
+	p := &pendingRPC{addr: normalizeAddr(addr), resp: make(chan *message, 1), sent: time.Now()}
+	p.timer = time.AfterFunc(timeout, func() { t.remove(id, p) })
+	t.pending[id] = p
+	return p.resp, nil
+}
+
+// deliver hands the response over to the RPC it answers, provided that it comes from
+// the address the request was sent to. It returns false if the response is unexpected
+func (t *rpcTracker) deliver(resp *message, from string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.pending[resp.RPCID]
+	if !ok || p.addr != normalizeAddr(from) { // Late, duplicate or forged response
+		return false
+	}
+	delete(t.pending, resp.RPCID)
+	p.timer.Stop()
+	p.resp <- resp // Never blocks, every channel has room for exactly one response
+	close(p.resp)
+	return true
+}
+
+// rtt returns the time elapsed since the request answered by the response was sent,
+// provided that the RPC is pending and the response comes from the address the request
+// was sent to. It returns false otherwise
+func (t *rpcTracker) rtt(resp *message, from string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.pending[resp.RPCID]
+	if !ok || p.addr != normalizeAddr(from) {
+		return 0, false
+	}
+	return time.Since(p.sent), true
+}
+
+// cancel removes the RPC with the ID specified, if it is still pending
+func (t *rpcTracker) cancel(id KademliaID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.pending[id]; ok {
+		delete(t.pending, id)
+		p.timer.Stop()
+		close(p.resp)
+	}
+}
+
+// remove removes the RPC with the ID specified if it is still the pending RPC p
+func (t *rpcTracker) remove(id KademliaID, p *pendingRPC) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending[id] == p {
+		delete(t.pending, id)
+		close(p.resp)
+	}
+}
+
+// close cancels every pending RPC and refuses the new ones
+func (t *rpcTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for id, p := range t.pending {
+		delete(t.pending, id)
+		p.timer.Stop()
+		close(p.resp)
+	}
+}
+
+// len returns the number of pending RPCs
+func (t *rpcTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// normalizeAddr returns the canonical form of a "host:port" address, so that
+// the same endpoint always compares equal whatever its original notation
+func normalizeAddr(addr string) string {
+	ip, port, err := splitAddr(addr)
+	if err != nil || ip == nil {
+		return addr
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// sameAddress returns true if both addresses designate the same endpoint
+func sameAddress(a, b string) bool {
+	return normalizeAddr(a) == normalizeAddr(b)
+}
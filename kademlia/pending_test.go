@@ -0,0 +1,106 @@
+package kademlia
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const peerAddr = "10.0.0.1:4000"
+
+func TestRPCTrackerDeliver(t *testing.T) {
+	tracker := newRPCTracker(maxPendingRPCs)
+	id := *NewRandomKademliaID()
+	ch, err := tracker.add(id, peerAddr, time.Second)
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	resp := &message{Type: pingResponse, RPCID: id}
+	// Responses from other addresses must be discarded
+	if tracker.deliver(resp, "10.0.0.2:4000") {
+		t.Error("deliver failed: response from the wrong address accepted")
+	}
+	// The same endpoint in another notation is accepted
+	if !tracker.deliver(resp, "[::ffff:10.0.0.1]:4000") {
+		t.Error("deliver failed: response from the right address discarded")
+	}
+	if got, ok := <-ch; !ok || got != resp {
+		t.Error("deliver failed: response not received")
+	}
+	// Duplicate responses must be discarded without blocking or panicking
+	if tracker.deliver(resp, peerAddr) {
+		t.Error("deliver failed: duplicate response accepted")
+	}
+	if tracker.len() != 0 {
+		t.Error("deliver failed: answered RPC still pending")
+	}
+}
+
+func TestRPCTrackerTimeout(t *testing.T) {
+	tracker := newRPCTracker(maxPendingRPCs)
+	id := *NewRandomKademliaID()
+	ch, _ := tracker.add(id, peerAddr, 10*time.Millisecond)
+	// The RPC is removed when its deadline expires
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("add failed: response received before any delivery")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("add failed: RPC not removed at its deadline")
+	}
+	if tracker.len() != 0 {
+		t.Error("add failed: timed out RPC still pending")
+	}
+	// Late responses must be discarded
+	if tracker.deliver(&message{Type: pingResponse, RPCID: id}, peerAddr) {
+		t.Error("deliver failed: late response accepted")
+	}
+}
+
+func TestRPCTrackerLimits(t *testing.T) {
+	tracker := newRPCTracker(2)
+	id := *NewRandomKademliaID()
+	tracker.add(id, peerAddr, time.Second)
+	// The same ID cannot be pending twice
+	if _, err := tracker.add(id, peerAddr, time.Second); !errors.Is(err, errDuplicateRPC) {
+		t.Errorf("add failed: expected duplicate error, %v returned", err)
+	}
+	// No more than the maximum number of RPCs can be pending
+	tracker.add(*NewRandomKademliaID(), peerAddr, time.Second)
+	if _, err := tracker.add(*NewRandomKademliaID(), peerAddr, time.Second); !errors.Is(err, ErrTooManyRPCs) {
+		t.Errorf("add failed: expected too many RPCs, %v returned", err)
+	}
+	// Cancelling frees a slot
+	tracker.cancel(id)
+	if _, err := tracker.add(*NewRandomKademliaID(), peerAddr, time.Second); err != nil {
+		t.Errorf("add failed: %v", err)
+	}
+	// Closing fails every pending RPC and refuses the new ones
+	tracker.close()
+	if tracker.len() != 0 {
+		t.Error("close failed: RPCs still pending")
+	}
+	if _, err := tracker.add(*NewRandomKademliaID(), peerAddr, time.Second); !errors.Is(err, ErrClosed) {
+		t.Errorf("add failed: expected closed, %v returned", err)
+	}
+}
+
+func TestRPCTrackerRTT(t *testing.T) {
+	tracker := newRPCTracker(maxPendingRPCs)
+	id := *NewRandomKademliaID()
+	tracker.add(id, peerAddr, time.Second)
+	resp := &message{Type: pingResponse, RPCID: id}
+	time.Sleep(10 * time.Millisecond)
+	// Only the responses from the right address are timed
+	if _, ok := tracker.rtt(resp, "10.0.0.2:4000"); ok {
+		t.Error("rtt failed: response from the wrong address timed")
+	}
+	if rtt, ok := tracker.rtt(resp, peerAddr); !ok || rtt < 10*time.Millisecond {
+		t.Errorf("rtt failed: round-trip time %v shorter than the actual delay", rtt)
+	}
+	tracker.deliver(resp, peerAddr)
+	if _, ok := tracker.rtt(resp, peerAddr); ok {
+		t.Error("rtt failed: answered RPC timed")
+	}
+}
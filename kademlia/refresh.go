@@ -0,0 +1,24 @@
+package kademlia
+
+// refreshBuckets keeps the buckets of the routing table fresh until the node is closed. Every bucket
+// holding contacts that no lookup has used within the refresh interval is refreshed with a
+// lookup for a random ID in its range, as the paper describes
+func (k *Kademlia) refreshBuckets() {
+	for {
+		stale, wait := k.Net.RT.staleBuckets(k.config.Clock.Now(), k.config.RefreshInterval)
+		for _, target := range stale {
+			if k.ctx.Err() != nil {
+				return
+			}
+			k.LookupContactContext(k.ctx, target) // Marks the bucket as used
+		}
+		if len(stale) > 0 { // Check again, the lookups may have taken a while
+			continue
+		}
+		select {
+		case <-k.config.Clock.After(wait): // Wait for the next bucket to go stale
+		case <-k.ctx.Done():
+			return
+		}
+	}
+}
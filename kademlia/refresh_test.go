@@ -0,0 +1,160 @@
+package kademlia
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock definition
+// implements the Clock interface with a time that only moves forward when told to.
+// The channels of an idle fakeClock do not fire, so that the periodic routines stay
+// idle while the test drives them by hand, until the clock is resumed
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+	idle    bool
+}
+
+// fakeWaiter definition
+// stores a channel returned by After together with the time it fires at
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the time forward by d, firing the channels that are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if c.idle || w.at.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = waiters
+}
+
+// setIdle stops or resumes firing the channels, the ones due by then fire with the next Advance
+func (c *fakeClock) setIdle(idle bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idle = idle
+}
+
+// waitForWaiters blocks until n routines are waiting on the clock
+func (c *fakeClock) waitForWaiters(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiters)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fakeClock: %d routines waiting on the clock instead of %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRandomIDInBucket(t *testing.T) {
+	me := NewContact(NewRandomKademliaID(), "localhost:8000")
+	tree := NewTreeRoutingTable(me, 0)
+	for i := 0; i < 10*bucketSize; i++ { // Split some buckets
+		tree.AddContact(NewContact(NewRandomKademliaID(), fmt.Sprintf("localhost:%d", 8001+i)))
+	}
+	for _, rt := range []*RoutingTable{NewRoutingTable(me), tree} {
+		for index, bucket := range rt.buckets {
+			for i := 0; i < 10; i++ {
+				if got := rt.getBucketIndex(bucket.RandomID()); got != index {
+					t.Fatalf("RandomID failed: ID in bucket %d, expected %d", got, index)
+				}
+			}
+		}
+	}
+}
+
+func TestStaleBuckets(t *testing.T) {
+	rt, id := fullBucketTable()
+	rt.AddContact(NewContact(NewKademliaID("4000000000000000000000000000000000000000"), "localhost:9000"))
+	now := newFakeClock().Now()
+	// Buckets are considered used when their first contacts are seen
+	if stale, wait := rt.staleBuckets(now, time.Hour); len(stale) != 0 || wait != time.Hour {
+		t.Fatalf("staleBuckets failed: %v stale, %v wait", stale, wait)
+	}
+	rt.touchBucket(id(0), now.Add(30*time.Minute))
+	stale, wait := rt.staleBuckets(now.Add(time.Hour), time.Hour)
+	if len(stale) != 1 || rt.getBucketIndex(stale[0]) != 1 || wait != 30*time.Minute {
+		t.Errorf("staleBuckets failed: %v stale, %v wait", stale, wait)
+	}
+}
+
+func TestRefreshBuckets(t *testing.T) {
+	nodes := newTestCluster(t, 10)
+	clock := newFakeClock()
+	start := clock.Now()
+	mn := nodes[0].Net.Transport.(*MemoryTransport).network
+	node := newTestNodeConfig(t, mn, NewRandomKademliaID(), listenPort+len(nodes), Config{Clock: clock})
+	if err := node.Join(nodes[0].Net.RT.me.Address); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	lastUsed := func() map[int]time.Time {
+		node.Net.RT.mu.RLock()
+		defer node.Net.RT.mu.RUnlock()
+		used := make(map[int]time.Time)
+		for i, b := range node.Net.RT.buckets {
+			if b.Len() > 0 {
+				used[i] = b.lastUsed
+			}
+		}
+		return used
+	}
+	// Nothing is refreshed before the interval elapses
+	clock.waitForWaiters(t, 3) // The refreshing, expiring and replicating routines
+	clock.Advance(node.config.RefreshInterval / 2)
+	for i, used := range lastUsed() {
+		if used.After(start) {
+			t.Errorf("refreshBuckets failed: bucket %d refreshed too early", i)
+		}
+	}
+	// Within two more intervals every bucket has gone stale and has been refreshed
+	for i := 0; i < 2; i++ {
+		clock.Advance(node.config.RefreshInterval)
+		clock.waitForWaiters(t, 3)
+	}
+	buckets := lastUsed()
+	if len(buckets) == 0 {
+		t.Fatal("Join failed: no bucket filled")
+	}
+	for i, used := range buckets {
+		if !used.Equal(clock.Now()) {
+			t.Errorf("refreshBuckets failed: bucket %d last used at %v, expected %v", i, used, clock.Now())
+		}
+	}
+}
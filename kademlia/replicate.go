@@ -0,0 +1,75 @@
+package kademlia
+
+import (
+	"sync"
+	"time"
+)
+
+// replicateValues keeps the values held by the node replicated on the k closest nodes to
+// their key until the node is closed. As the paper describes, every node republishes
+// hourly the values it holds, but a value that a STORE reached within the replication
+// interval is skipped: the sender reached the other replicas as well
+func (k *Kademlia) replicateValues() {
+	for {
+		wait := k.replicate(k.config.Clock.Now())
+		select {
+		case <-k.config.Clock.After(wait): // Wait for the next value to be due
+		case <-k.ctx.Done():
+			return
+		}
+	}
+}
+
+// replicate republishes the values held by the node that were not stored within the
+// replication interval before now, and returns the time until the next one is due
+func (k *Kademlia) replicate(now time.Time) time.Duration {
+	type value struct {
+		key  string
+		data []byte
+		ttl  time.Duration
+	}
+	var due []value
+	held := make(map[string]bool)
+	wait := k.config.ReplicateInterval
+	k.config.Store.Range(func(key string, data []byte, expires time.Time) bool {
+		if expired(expires, now) { // Left to expireValues
+			return true
+		}
+		held[key] = true
+		last, _ := k.stored.LoadOrStore(key, now) // A value loaded at startup is due an interval later
+		if next := last.(time.Time).Add(k.config.ReplicateInterval); next.After(now) {
+			if next.Sub(now) < wait {
+				wait = next.Sub(now)
+			}
+		} else {
+			due = append(due, value{key: key, data: data, ttl: timeToLive(expires, now)})
+		}
+		return true
+	})
+	k.stored.Range(func(key, _ interface{}) bool { // Forget the values deleted or expired
+		if !held[key.(string)] {
+			k.stored.Delete(key)
+		}
+		return true
+	})
+	for _, v := range due {
+		if k.ctx.Err() != nil {
+			return wait
+		}
+		k.stored.Store(v.key, now)
+		closest, _ := k.LookupContactContext(k.ctx, NewKademliaID(v.key))
+		var wg sync.WaitGroup
+		for _, c := range closest {
+			if c.ID.Equals(k.Net.RT.me.ID) {
+				continue
+			}
+			wg.Add(1)
+			go func(c Contact) {
+				defer wg.Done()
+				k.Net.SendStoreMessageContext(k.ctx, v.data, v.ttl, &c) // Without pushing the expiration back
+			}(c)
+		}
+		wg.Wait()
+	}
+	return wait
+}
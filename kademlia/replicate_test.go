@@ -0,0 +1,151 @@
+package kademlia
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// storeCounter definition
+// wraps a Transport and counts the STORE requests sent through it
+type storeCounter struct {
+	Transport
+	stores *int64
+}
+
+func (t storeCounter) WriteTo(data []byte, addr string) error {
+	if msg, err := decodeMessage(data); err == nil && msg.Type == storeRequest {
+		atomic.AddInt64(t.stores, 1)
+	}
+	return t.Transport.WriteTo(data, addr)
+}
+
+func TestReplicateSkipsStoredValues(t *testing.T) {
+	const size, k, values, hours = 20, 5, 10, 4
+	clock := newFakeClock()
+	clock.setIdle(true)
+	start := clock.Now()
+	var stores int64
+	mn := NewMemoryNetwork()
+	nodes := make([]*Kademlia, size)
+	for i := range nodes {
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(listenPort+i))
+		node, err := NewKademlia(NewContact(NewRandomKademliaID(), addr), Config{K: k, Clock: clock})
+		if err != nil {
+			t.Fatalf("NewKademlia failed: %v", err)
+		}
+		tr, _ := mn.Listen(addr)
+		t.Cleanup(func() { node.Close() })
+		if err := node.StartTransport(storeCounter{Transport: tr, stores: &stores}); err != nil {
+			t.Fatalf("StartTransport failed: %v", err)
+		}
+		if i > 0 {
+			if err := node.Join(nodes[0].Net.RT.me.Address); err != nil {
+				t.Fatalf("Join failed: %v", err)
+			}
+		}
+		nodes[i] = node
+	}
+	var keys []string
+	for i := 0; i < values; i++ {
+		key, err := nodes[0].StoreContext(context.Background(), []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatalf("StoreContext failed: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	// Every hour the timer of each node fires a minute after the one of the previous node
+	hour := 0
+	simulate := func(naive bool) int64 {
+		atomic.StoreInt64(&stores, 0)
+		for h := 0; h < hours; h++ {
+			hour++
+			for i, node := range nodes {
+				clock.Advance(start.Add(time.Duration(hour)*time.Hour + time.Duration(i)*time.Minute).Sub(clock.Now()))
+				if naive { // As if no STORE had reached the node
+					node.stored.Range(func(key, _ interface{}) bool {
+						node.stored.Store(key, time.Time{})
+						return true
+					})
+				}
+				node.replicate(clock.Now())
+			}
+		}
+		return atomic.LoadInt64(&stores)
+	}
+	before := simulate(true)
+	after := simulate(false)
+	t.Logf("STORE messages in %d hours for %d values: %d replicating naively, %d skipping the stored values", hours, values, before, after)
+	// Only the first replica whose timer fires republishes a value, to the k-1 other ones
+	if max := int64(hours * values * (k - 1)); after == 0 || after > max {
+		t.Errorf("replicate failed: %d STORE messages instead of at most %d", after, max)
+	}
+	if after*(k-1) > before { // Naively each of the k replicas republishes every hour
+		t.Errorf("replicate failed: %d STORE messages, the naive replication sends %d", after, before)
+	}
+	// The replicas keep the expiration time set by the publisher
+	expires := start.Add(nodes[0].config.ExpirationDelay)
+	for _, key := range keys {
+		holders := 0
+		for _, node := range nodes {
+			if _, at, err := node.config.Store.Get(key); err == nil {
+				holders++
+				if !at.Equal(expires) {
+					t.Errorf("replicate failed: %s expires at %v instead of %v", key, at, expires)
+				}
+			}
+		}
+		if holders < k {
+			t.Errorf("replicate failed: %s held by %d nodes instead of %d", key, holders, k)
+		}
+	}
+	// Once the publisher stops refreshing the values, they expire from the whole network
+	for _, key := range keys {
+		nodes[0].ForgetData(key)
+	}
+	clock.setIdle(false)
+	clock.Advance(expires.Sub(clock.Now()))
+	for _, key := range keys {
+		if _, ok := nodes[size-1].LookupData(key); ok {
+			t.Errorf("LookupData failed: %s found after its expiration", key)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, node := range nodes {
+		for held := true; held; {
+			held = false
+			node.config.Store.Range(func(string, []byte, time.Time) bool {
+				held = true
+				return false
+			})
+			if held && time.Now().After(deadline) {
+				t.Fatal("expireValues failed: values still held after their expiration")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestReplicatedValueExpires(t *testing.T) {
+	clock := newFakeClock()
+	node := newTestNodeConfig(t, NewMemoryNetwork(), NewRandomKademliaID(), listenPort, Config{Clock: clock})
+	clock.waitForWaiters(t, 3) // The refreshing, expiring and replicating routines
+	// A replica with an hour left expires long before the delay the expiring routine sleeps for
+	node.handleRPC(storeRequest, [][]byte{[]byte(objContent), encodeTTL(time.Hour)})
+	clock.waitForWaiters(t, 4) // Woken up, the expiring routine waits for the replica
+	clock.Advance(time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, err := node.config.Store.Get(objHash); err != nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expireValues failed: replica still held after its time to live")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
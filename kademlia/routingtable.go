@@ -1,19 +1,69 @@
 package kademlia
 
-const bucketSize = 20
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const penaltyDuration = time.Hour // Time during which a penalized contact is not added back
 
 // RoutingTable definition
-// keeps a reference contact of me and an array of buckets
+// keeps a reference contact of me and the buckets, sorted by range and covering
+// the whole ID space. The fixed layout has one bucket per length of the prefix
+// shared with me, while the tree layout starts with a single bucket and splits
+// the full ones on demand. New contacts are subject to the diversity limits,
+// and penalized ones are refused for a while. It is safe for concurrent use:
+// me and the layout never change, the buckets, the limits, the rejections and
+// the penalties are guarded by mu
 type RoutingTable struct {
-	me      Contact
-	buckets [IDLength * 8]*bucket
+	me           Contact
+	mu           sync.RWMutex
+	buckets      []*bucket
+	tree         bool // Tree layout
+	relaxedDepth int  // Levels above the bucket of me whose buckets can be split too
+	limits       DiversityLimits
+	rejected     DiversityRejections
+	penalized    map[penaltyKey]time.Time // Time until which each penalized contact is refused
+}
+
+// penaltyKey definition
+// identifies a penalized contact by its ID and its normalized address, since the
+// ID alone may be claimed by a node other than the one that misbehaved
+type penaltyKey struct {
+	id   KademliaID
+	addr string
 }
 
-// NewRoutingTable returns a new instance of a RoutingTable
+// NewRoutingTable returns a new instance of a RoutingTable with the fixed layout
 func NewRoutingTable(me Contact) *RoutingTable {
-	routingTable := &RoutingTable{}
-	for i := 0; i < IDLength*8; i++ {
-		routingTable.buckets[i] = newBucket()
+	return newRoutingTable(me, bucketSize, false, 0)
+}
+
+// NewTreeRoutingTable returns a new instance of a RoutingTable with the tree layout. A full
+// Bucket is split when its range includes me, as the paper describes, or when it shares at
+// least as many bits with me as the Bucket of me minus relaxedDepth. The relaxed rule keeps
+// more than a Bucket holds in the neighborhood of me, 0 disables it
+func NewTreeRoutingTable(me Contact, relaxedDepth int) *RoutingTable {
+	return newRoutingTable(me, bucketSize, true, relaxedDepth)
+}
+
+// newRoutingTable returns a new instance of a RoutingTable with the tree layout or the
+// fixed one, whose Buckets hold size contacts
+func newRoutingTable(me Contact, size int, tree bool, relaxedDepth int) *RoutingTable {
+	routingTable := &RoutingTable{tree: tree, relaxedDepth: relaxedDepth, penalized: make(map[penaltyKey]time.Time)}
+	if tree { // A single Bucket covering the whole ID space
+		routingTable.buckets = []*bucket{newBucket(KademliaID{}, 0, size)}
+	} else {
+		for i := 0; i < IDLength*8; i++ { // The Bucket i holds the IDs sharing exactly i bits with me
+			prefix := *me.ID
+			prefix[i/8] ^= 0x80 >> uint(i%8)
+			routingTable.buckets = append(routingTable.buckets, newBucket(prefix, i+1, size))
+		}
 	}
 	routingTable.me = me
 	return routingTable
@@ -21,41 +71,283 @@ func NewRoutingTable(me Contact) *RoutingTable {
 
 // AddContact add a new contact to the correct Bucket
 func (routingTable *RoutingTable) AddContact(contact Contact) bool {
-	bucketIndex := routingTable.getBucketIndex(contact.ID)
-	bucket := routingTable.buckets[bucketIndex]
-	return bucket.AddContact(contact)
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+	added, _ := routingTable.add(contact)
+	return added
 }
 
-// FindClosestContacts finds the count closest Contacts to the target in the RoutingTable
-func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count int) []Contact {
-	var candidates ContactCandidates
-	bucketIndex := routingTable.getBucketIndex(target)
-	bucket := routingTable.buckets[bucketIndex]
+// tryAddContact adds the contact to the correct Bucket, or moves it to the front if it
+// already existed, returning true if it is added as AddContact does. If the Bucket is
+// full, the contact goes to its replacement cache and its least recently seen contact
+// is returned
+func (routingTable *RoutingTable) tryAddContact(contact Contact) (bool, *Contact) {
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+	added, bucket := routingTable.add(contact)
+	if added || bucket == nil || bucket.Contains(contact.ID) {
+		return added, nil
+	}
+	lrs := bucket.list.Back().Value.(Contact)
+	return false, &lrs
+}
+
+// add adds the contact to the Bucket covering its ID as bucket.AddContact does, splitting
+// the Bucket first while it is full and the layout allows it, and returns the Bucket. A new
+// contact exceeding the diversity limits is rejected, with a nil Bucket, as is a penalized
+// contact seen at the same address before the end of its penalty
+func (routingTable *RoutingTable) add(contact Contact) (bool, *bucket) {
+	key := penaltyKey{*contact.ID, normalizeAddr(contact.Address)}
+	if until, ok := routingTable.penalized[key]; ok {
+		if contact.LastSeen.Before(until) {
+			return false, nil
+		}
+		delete(routingTable.penalized, key)
+	}
+	for {
+		index := routingTable.getBucketIndex(contact.ID)
+		bucket := routingTable.buckets[index]
+		if bucket.Contains(contact.ID) {
+			return bucket.AddContact(contact), bucket
+		}
+		if bucket.Len() < bucket.size || !routingTable.splittable(bucket) {
+			if !routingTable.admit(bucket, contact) {
+				return false, nil
+			}
+			return bucket.AddContact(contact), bucket
+		}
+		low, high := bucket.split()
+		routingTable.buckets = append(routingTable.buckets[:index+1], routingTable.buckets[index:]...)
+		routingTable.buckets[index], routingTable.buckets[index+1] = low, high
+	}
+}
+
+// splittable returns true if the tree layout allows the Bucket to be split
+func (routingTable *RoutingTable) splittable(bucket *bucket) bool {
+	if !routingTable.tree || bucket.depth == IDLength*8 {
+		return false
+	}
+	if bucket.Covers(routingTable.me.ID) {
+		return true
+	}
+	mine := routingTable.buckets[routingTable.getBucketIndex(routingTable.me.ID)]
+	return routingTable.relaxedDepth > 0 && commonPrefixLen(&bucket.prefix, routingTable.me.ID) >= mine.depth-routingTable.relaxedDepth
+}
 
-	candidates.Append(bucket.GetContactAndCalcDistance(target))
+// RemoveContact removes the contact with the ID specified from its Bucket, promoting the
+// most recently seen contact of the replacement cache in its place. It returns false if
+// the contact was not in the RoutingTable
+func (routingTable *RoutingTable) RemoveContact(id *KademliaID) bool {
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+	bucket := routingTable.buckets[routingTable.getBucketIndex(id)]
+	if !bucket.Remove(id) {
+		return false
+	}
+	routingTable.promote(bucket)
+	return true
+}
 
-	for i := 1; (bucketIndex-i >= 0 || bucketIndex+i < IDLength*8) && candidates.Len() < count; i++ {
-		if bucketIndex-i >= 0 {
-			bucket = routingTable.buckets[bucketIndex-i]
-			candidates.Append(bucket.GetContactAndCalcDistance(target))
+// promote moves the most recently seen contact of the replacement cache of the Bucket that
+// fits the diversity limits to the back of the Bucket, as it was not seen since it was cached.
+// The cached contacts are checked again, since the Bucket may have changed since then
+func (routingTable *RoutingTable) promote(bucket *bucket) {
+	for e := bucket.replacements.Front(); e != nil; e = e.Next() {
+		if routingTable.admit(bucket, e.Value.(Contact)) {
+			bucket.list.PushBack(bucket.replacements.Remove(e))
+			return
 		}
-		if bucketIndex+i < IDLength*8 {
-			bucket = routingTable.buckets[bucketIndex+i]
-			candidates.Append(bucket.GetContactAndCalcDistance(target))
+	}
+}
+
+// hasContact returns true if the contact with the ID specified is in the RoutingTable
+func (routingTable *RoutingTable) hasContact(id *KademliaID) bool {
+	_, ok := routingTable.lookupContact(id)
+	return ok
+}
+
+// lookupContact returns the contact with the ID specified, with its liveness
+// metadata, and true if it is in the RoutingTable
+func (routingTable *RoutingTable) lookupContact(id *KademliaID) (Contact, bool) {
+	routingTable.mu.RLock()
+	defer routingTable.mu.RUnlock()
+	element := routingTable.buckets[routingTable.getBucketIndex(id)].find(id)
+	if element == nil {
+		return Contact{}, false
+	}
+	return element.Value.(Contact), true
+}
+
+// FailContact records an RPC that the contact failed to answer, if the routing table
+// knows it at the same address. After maxContactFailures consecutive failures, the
+// contact is removed as RemoveContact does. It returns true if the contact is removed
+func (routingTable *RoutingTable) FailContact(contact Contact) bool {
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+	bucket := routingTable.buckets[routingTable.getBucketIndex(contact.ID)]
+	if !bucket.Fail(contact) {
+		return false
+	}
+	routingTable.promote(bucket)
+	return true
+}
+
+// PenalizeContact evicts the contact, which misbehaved at the time now, from its Bucket
+// and from the replacement cache, promoting a replacement in its place as RemoveContact
+// does. Only a contact known at the same address is evicted, a node known under its ID
+// elsewhere is another node. The contact is refused at its address until penaltyDuration
+// after now, so that the sightings of its misbehavior waiting to be processed do not add
+// it back. It returns false if the contact was in neither
+func (routingTable *RoutingTable) PenalizeContact(contact Contact, now time.Time) bool {
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+	for penalized, until := range routingTable.penalized { // Forget the penalties served
+		if !until.After(now) {
+			delete(routingTable.penalized, penalized)
 		}
 	}
+	routingTable.penalized[penaltyKey{*contact.ID, normalizeAddr(contact.Address)}] = now.Add(penaltyDuration)
+	bucket := routingTable.buckets[routingTable.getBucketIndex(contact.ID)]
+	cached := false
+	if element := findIn(bucket.replacements, contact.ID); element != nil && sameAddress(element.Value.(Contact).Address, contact.Address) {
+		bucket.replacements.Remove(element)
+		cached = true
+	}
+	if bucket.findAt(contact) == nil || !bucket.Remove(contact.ID) {
+		return cached
+	}
+	routingTable.promote(bucket)
+	return true
+}
 
-	candidates.Sort()
+// BucketInfo definition
+// describes the content of a Bucket of the RoutingTable
+type BucketInfo struct {
+	Index        int        `json:"index"`        // Position of the Bucket, sorted by range
+	Prefix       KademliaID `json:"prefix"`       // The range of the Bucket is made of the IDs starting with
+	Depth        int        `json:"depth"`        // the Depth leading bits of Prefix
+	Contacts     []Contact  `json:"contacts"`     // From the most to the least recently seen
+	Replacements []Contact  `json:"replacements"` // Replacement cache, from the most to the least recently seen
+}
+
+// Range returns the range of the Bucket in CIDR notation: its Prefix and its Depth
+func (info *BucketInfo) Range() string {
+	return fmt.Sprintf("%s/%d", info.Prefix.String(), info.Depth)
+}
+
+// Snapshot definition
+// describes the content of the whole RoutingTable at some point in time
+type Snapshot struct {
+	Me       Contact             `json:"me"`
+	Tree     bool                `json:"tree"`     // Tree layout
+	Buckets  []BucketInfo        `json:"buckets"`  // Only the Buckets holding any contact
+	Rejected DiversityRejections `json:"rejected"` // Contacts rejected by the diversity limits
+}
+
+// Me returns the contact of the node owning the RoutingTable
+func (routingTable *RoutingTable) Me() Contact {
+	return routingTable.me
+}
 
-	if count > candidates.Len() {
-		count = candidates.Len()
+// Snapshot returns a consistent Snapshot of the RoutingTable
+func (routingTable *RoutingTable) Snapshot() Snapshot {
+	routingTable.mu.RLock()
+	defer routingTable.mu.RUnlock()
+	return Snapshot{
+		Me:       routingTable.me,
+		Tree:     routingTable.tree,
+		Buckets:  routingTable.bucketInfos(),
+		Rejected: routingTable.rejected,
 	}
+}
+
+// Buckets returns a snapshot of the Buckets of the RoutingTable that hold any contact,
+// either in the Bucket itself or in its replacement cache
+func (routingTable *RoutingTable) Buckets() []BucketInfo {
+	routingTable.mu.RLock()
+	defer routingTable.mu.RUnlock()
+	return routingTable.bucketInfos()
+}
+
+// bucketInfos is like Buckets for callers already holding mu
+func (routingTable *RoutingTable) bucketInfos() []BucketInfo {
+	var buckets []BucketInfo
+	for i, bucket := range routingTable.buckets {
+		if bucket.Len() == 0 && bucket.replacements.Len() == 0 {
+			continue
+		}
+		buckets = append(buckets, BucketInfo{
+			Index:        i,
+			Prefix:       bucket.prefix,
+			Depth:        bucket.depth,
+			Contacts:     bucket.Contacts(),
+			Replacements: bucket.Replacements(),
+		})
+	}
+	return buckets
+}
+
+// Contacts returns a snapshot of every Contact in the RoutingTable, sorted
+// by Bucket and from the most to the least recently seen in each Bucket
+func (routingTable *RoutingTable) Contacts() []Contact {
+	routingTable.mu.RLock()
+	defer routingTable.mu.RUnlock()
+	var contacts []Contact
+	for _, bucket := range routingTable.buckets {
+		contacts = append(contacts, bucket.Contacts()...)
+	}
+	return contacts
+}
+
+// bucketContacts returns a snapshot of the Contacts in the Bucket with the index specified,
+// from the most to the least recently seen
+func (routingTable *RoutingTable) bucketContacts(index int) []Contact {
+	routingTable.mu.RLock()
+	defer routingTable.mu.RUnlock()
+	return routingTable.buckets[index].Contacts()
+}
 
+// FindClosestContacts finds the count closest Contacts to the target in the RoutingTable.
+// The Buckets are visited by increasing distance of their range to the target: since the
+// ranges do not overlap, every contact of a Bucket is closer to the target than the ones
+// of the Buckets visited after it, so the search stops as soon as count contacts are found
+func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count int) []Contact {
+	routingTable.mu.RLock()
+	defer routingTable.mu.RUnlock()
+	buckets := make([]*bucket, 0, len(routingTable.buckets))
+	distances := make([]KademliaID, 0, len(routingTable.buckets))
+	for _, bucket := range routingTable.buckets {
+		if bucket.Len() > 0 {
+			buckets = append(buckets, bucket)
+			distances = append(distances, bucket.minDistance(target))
+		}
+	}
+	var candidates ContactCandidates
+	for candidates.Len() < count && len(buckets) > 0 {
+		closest := 0 // Few Buckets are usually needed, select them one by one instead of sorting
+		for i := 1; i < len(buckets); i++ {
+			if distances[i].Less(&distances[closest]) {
+				closest = i
+			}
+		}
+		candidates.Append(buckets[closest].GetContactAndCalcDistance(target))
+		last := len(buckets) - 1
+		buckets[closest], distances[closest] = buckets[last], distances[last]
+		buckets, distances = buckets[:last], distances[:last]
+	}
+	candidates.Sort()
 	return candidates.GetContacts(count)
 }
 
 // getBucketIndex get the correct Bucket index for the KademliaID
 func (routingTable *RoutingTable) getBucketIndex(id *KademliaID) int {
+	if routingTable.tree {
+		for i, bucket := range routingTable.buckets {
+			if bucket.Covers(id) {
+				return i
+			}
+		}
+	}
 	distance := id.CalcDistance(routingTable.me.ID)
 	for i := 0; i < IDLength; i++ {
 		for j := 0; j < 8; j++ {
@@ -67,3 +359,98 @@ func (routingTable *RoutingTable) getBucketIndex(id *KademliaID) int {
 
 	return IDLength*8 - 1
 }
+
+// staleBuckets returns a random ID in the range of each Bucket holding contacts that have
+// not been used within the interval at the time now, together with the time left until
+// the next one goes stale. Buckets that got their first contacts since the last call are
+// considered used now
+func (routingTable *RoutingTable) staleBuckets(now time.Time, interval time.Duration) ([]*KademliaID, time.Duration) {
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+	var stale []*KademliaID
+	wait := interval
+	for _, bucket := range routingTable.buckets {
+		if bucket.Len() == 0 {
+			continue
+		}
+		if bucket.lastUsed.IsZero() {
+			bucket.lastUsed = now
+		}
+		left := bucket.lastUsed.Add(interval).Sub(now)
+		if left <= 0 {
+			stale = append(stale, bucket.RandomID())
+		} else if left < wait {
+			wait = left
+		}
+	}
+	return stale, wait
+}
+
+// touchBucket marks the Bucket whose range includes the ID specified as used at the time now
+func (routingTable *RoutingTable) touchBucket(id *KademliaID, now time.Time) {
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+	routingTable.buckets[routingTable.getBucketIndex(id)].lastUsed = now
+}
+
+// savedContact definition
+// stores a Contact of the RoutingTable in the file written by Save
+type savedContact struct {
+	ID       string    `json:"id"`
+	Address  string    `json:"address"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Save writes the contacts of the RoutingTable, with their IDs, endpoints and last-seen
+// times, to the file at path. The file is replaced atomically, so that a crash while
+// saving never leaves a truncated table behind
+func (routingTable *RoutingTable) Save(path string) error {
+	var saved []savedContact
+	for _, c := range routingTable.Contacts() {
+		saved = append(saved, savedContact{ID: c.ID.String(), Address: c.Address, LastSeen: c.LastSeen})
+	}
+	data, err := json.MarshalIndent(saved, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Only left behind if something failed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load adds the contacts saved by Save in the file at path to the RoutingTable, with their
+// last-seen times. The contacts are not checked, see Kademlia.Rejoin for that
+func (routingTable *RoutingTable) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var saved []savedContact
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for i := len(saved) - 1; i >= 0; i-- { // Save lists the most recently seen contacts first
+		s := saved[i]
+		id, err := ParseKademliaID(s.ID)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if id.Equals(routingTable.me.ID) { // A node never adds itself to the routing table
+			continue
+		}
+		contact := NewContact(id, s.Address)
+		contact.LastSeen = s.LastSeen
+		routingTable.AddContact(contact)
+	}
+	return nil
+}
@@ -1,7 +1,18 @@
 package kademlia
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"testing/quick"
+	"time"
 )
 
 const contact1 = "ffffffff00000000000000000000000000000000"
@@ -38,3 +49,446 @@ func TestRoutingTable(t *testing.T) {
 		}
 	}
 }
+
+func TestRoutingTableConcurrentAccess(t *testing.T) {
+	me := NewContact(NewRandomKademliaID(), "localhost:8000")
+	t.Run("fixed", func(t *testing.T) { testConcurrentAccess(t, NewRoutingTable(me)) })
+	t.Run("tree", func(t *testing.T) { testConcurrentAccess(t, NewTreeRoutingTable(me, 2)) })
+}
+
+// testConcurrentAccess adds contacts to rt while looking it up from several routines
+func testConcurrentAccess(t *testing.T, rt *RoutingTable) {
+	const writers, readers, rounds = 16, 16, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				rt.AddContact(NewContact(NewRandomKademliaID(), fmt.Sprintf("localhost:%d", w*rounds+i)))
+			}
+		}(w)
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				target := NewRandomKademliaID()
+				closest := rt.FindClosestContacts(target, bucketSize)
+				if len(closest) > bucketSize {
+					t.Errorf("FindClosestContacts failed: %d contacts returned", len(closest))
+					return
+				}
+				for j := 1; j < len(closest); j++ { // Every snapshot must be consistently sorted
+					if closest[j].distance.Less(closest[j-1].distance) {
+						t.Error("FindClosestContacts failed: contacts not sorted by distance")
+						return
+					}
+				}
+				_ = rt.Contacts()
+			}
+		}()
+	}
+	wg.Wait()
+	seen := make(map[KademliaID]bool)
+	for _, c := range rt.Contacts() {
+		if seen[*c.ID] {
+			t.Fatalf("AddContact failed: contact %s stored twice", c.ID)
+		}
+		seen[*c.ID] = true
+	}
+	for i := range rt.buckets {
+		if n := len(rt.bucketContacts(i)); n > bucketSize {
+			t.Errorf("AddContact failed: bucket %d holds %d contacts", i, n)
+		}
+	}
+}
+
+// fullBucketTable returns a RoutingTable whose Bucket 0 is full, together with the ID of the
+// ith contact added to it, so that the 0th is the least recently seen
+func fullBucketTable() (*RoutingTable, func(i int) *KademliaID) {
+	rt := NewRoutingTable(NewContact(NewKademliaID(nullID), "localhost:8000"))
+	id := func(i int) *KademliaID { return idInFirstBucket(byte(i)) }
+	for i := 0; i < bucketSize; i++ {
+		rt.AddContact(NewContact(id(i), fmt.Sprintf("localhost:%d", 8001+i)))
+	}
+	return rt, id
+}
+
+func TestRoutingTableReplacementCache(t *testing.T) {
+	rt, id := fullBucketTable()
+	// The contacts that do not fit are cached, bounded and most recently seen first
+	for i := bucketSize; i < bucketSize+replacementCacheSize+5; i++ {
+		if rt.AddContact(NewContact(id(i), fmt.Sprintf("localhost:%d", 8001+i))) {
+			t.Fatal("AddContact failed: contact added to a full bucket")
+		}
+	}
+	buckets := rt.Buckets()
+	if len(buckets) != 1 || buckets[0].Index != 0 || len(buckets[0].Contacts) != bucketSize {
+		t.Fatalf("Buckets failed: unexpected snapshot %+v", buckets)
+	}
+	cache := buckets[0].Replacements
+	if len(cache) != replacementCacheSize {
+		t.Fatalf("AddContact failed: %d cached contacts, expected %d", len(cache), replacementCacheSize)
+	}
+	if newest := id(bucketSize + replacementCacheSize + 4); !cache[0].ID.Equals(newest) {
+		t.Errorf("AddContact failed: cache front is %s, expected %s", cache[0].ID, newest)
+	}
+	// Removing a contact promotes the most recently seen replacement
+	if !rt.RemoveContact(id(0)) {
+		t.Fatal("RemoveContact failed: contact not removed")
+	}
+	if !rt.hasContact(cache[0].ID) || rt.hasContact(id(0)) {
+		t.Error("RemoveContact failed: replacement not promoted")
+	}
+	if n := len(rt.Buckets()[0].Replacements); n != replacementCacheSize-1 {
+		t.Errorf("RemoveContact failed: %d cached contacts, expected %d", n, replacementCacheSize-1)
+	}
+}
+
+func TestRoutingTableFailContact(t *testing.T) {
+	rt, id := fullBucketTable()
+	replacement := NewContact(id(bucketSize), "localhost:9000")
+	rt.AddContact(replacement)
+	// Failures reported for the ID at another address are not counted
+	for i := 0; i < maxContactFailures; i++ {
+		if rt.FailContact(NewContact(id(0), "localhost:9999")) {
+			t.Fatal("FailContact failed: contact evicted by failures at another address")
+		}
+	}
+	if !rt.hasContact(id(0)) {
+		t.Fatal("FailContact failed: contact evicted by failures at another address")
+	}
+	// Nor does a sighting of the ID at another address replace the contact known
+	rt.AddContact(NewContact(id(0), "localhost:9999"))
+	if c := rt.FindClosestContacts(id(0), 1); c[0].Address != "localhost:8001" {
+		t.Fatalf("AddContact failed: contact moved to %s", c[0].Address)
+	}
+	// A contact is only evicted after failing maxContactFailures times in a row
+	for i := 1; i < maxContactFailures; i++ {
+		if rt.FailContact(NewContact(id(0), "localhost:8001")) {
+			t.Fatalf("FailContact failed: contact evicted after %d failures", i)
+		}
+	}
+	rt.AddContact(NewContact(id(0), "localhost:8001")) // Seen again, the failures are cleared
+	for i := 1; i < maxContactFailures; i++ {
+		if rt.FailContact(NewContact(id(0), "localhost:8001")) {
+			t.Fatalf("FailContact failed: failures not cleared when the contact was seen")
+		}
+	}
+	if !rt.FailContact(NewContact(id(0), "localhost:8001")) {
+		t.Fatalf("FailContact failed: contact not evicted after %d failures", maxContactFailures)
+	}
+	if rt.hasContact(id(0)) || !rt.hasContact(replacement.ID) {
+		t.Error("FailContact failed: failing contact not replaced from the cache")
+	}
+	if rt.FailContact(NewContact(NewRandomKademliaID(), "localhost:9001")) {
+		t.Error("FailContact failed: unknown contact reported as evicted")
+	}
+}
+
+func TestRoutingTablePenalizeContact(t *testing.T) {
+	rt, id := fullBucketTable()
+	replacement := NewContact(id(bucketSize), "localhost:9000")
+	rt.AddContact(replacement)
+	now := time.Now()
+	// A node misbehaving under the ID of a contact, at another address, is another node
+	if rt.PenalizeContact(NewContact(id(1), "localhost:9999"), now) || !rt.hasContact(id(1)) {
+		t.Error("PenalizeContact failed: contact evicted for a node claiming its ID")
+	}
+	if !rt.PenalizeContact(NewContact(id(0), "localhost:8001"), now) {
+		t.Fatal("PenalizeContact failed: contact not evicted")
+	}
+	if rt.hasContact(id(0)) || !rt.hasContact(replacement.ID) {
+		t.Error("PenalizeContact failed: contact not replaced from the cache")
+	}
+	// The contact is refused while its penalty lasts, even if it was seen before it
+	rt.RemoveContact(replacement.ID) // Leave room for it
+	seen := NewContact(id(0), "localhost:8001")
+	for _, at := range []time.Time{now.Add(-time.Second), now.Add(penaltyDuration - time.Second)} {
+		seen.LastSeen = at
+		if rt.AddContact(seen) || rt.hasContact(id(0)) {
+			t.Errorf("AddContact failed: contact seen at %v added during its penalty", at)
+		}
+	}
+	seen.LastSeen = now.Add(penaltyDuration)
+	if !rt.AddContact(seen) {
+		t.Error("AddContact failed: contact refused after its penalty")
+	}
+}
+
+func TestRoutingTableLivenessMetadata(t *testing.T) {
+	rt, id := fullBucketTable()
+	now := time.Now()
+	// The first reply sets the round-trip time, the next ones are smoothed into it
+	seen := NewContact(id(0), "localhost:8001")
+	seen.LastSeen, seen.LastReplied, seen.RTT = now, now, 80*time.Millisecond
+	rt.AddContact(seen)
+	seen.LastSeen, seen.LastReplied, seen.RTT = now.Add(time.Second), now.Add(time.Second), 160*time.Millisecond
+	rt.AddContact(seen)
+	c, ok := rt.lookupContact(id(0))
+	if !ok || c.RTT != 90*time.Millisecond || !c.LastReplied.Equal(now.Add(time.Second)) {
+		t.Fatalf("AddContact failed: unexpected metadata %+v", c)
+	}
+	// Failures are counted until the contact is seen again, which only moves its last-seen time
+	rt.FailContact(seen)
+	if c, _ = rt.lookupContact(id(0)); c.Failures != 1 {
+		t.Errorf("FailContact failed: %d failures recorded, expected 1", c.Failures)
+	}
+	seen = NewContact(id(0), "localhost:8001")
+	seen.LastSeen = now.Add(2 * time.Second)
+	rt.AddContact(seen)
+	c, _ = rt.lookupContact(id(0))
+	if c.Failures != 0 || !c.LastSeen.Equal(seen.LastSeen) || !c.LastReplied.Equal(now.Add(time.Second)) || c.RTT != 90*time.Millisecond {
+		t.Errorf("AddContact failed: unexpected metadata %+v", c)
+	}
+	// A sighting of the ID at another address says nothing about the contact known
+	forged := NewContact(id(0), "localhost:9999")
+	forged.LastSeen, forged.LastReplied, forged.RTT = now.Add(3*time.Second), now.Add(3*time.Second), time.Millisecond
+	rt.AddContact(forged)
+	if c, _ = rt.lookupContact(id(0)); !c.LastSeen.Equal(seen.LastSeen) || c.RTT != 90*time.Millisecond {
+		t.Errorf("AddContact failed: metadata merged from another address %+v", c)
+	}
+}
+
+func TestRoutingTableSaveLoad(t *testing.T) {
+	rt, id := fullBucketTable()
+	far := NewContact(NewKademliaID("4000000000000000000000000000000000000000"), "localhost:9000")
+	far.LastSeen = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	rt.AddContact(far)
+	rt.AddContact(NewContact(id(5), "localhost:8006")) // Seen again, now the most recent of its bucket
+	path := filepath.Join(t.TempDir(), "routes")
+	if err := rt.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	// The reloaded table holds the same contacts in the same order
+	loaded := NewRoutingTable(rt.me)
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	expected, got := rt.Contacts(), loaded.Contacts()
+	if len(got) != len(expected) {
+		t.Fatalf("Load failed: %d contacts loaded, expected %d", len(got), len(expected))
+	}
+	for i := range expected {
+		if !got[i].ID.Equals(expected[i].ID) || got[i].Address != expected[i].Address || !got[i].LastSeen.Equal(expected[i].LastSeen) {
+			t.Errorf("Load failed: contact %d is %v, expected %v", i, got[i], expected[i])
+		}
+	}
+	// Missing and malformed files are reported
+	if err := loaded.Load(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Load failed: %v returned for a missing file", err)
+	}
+	ioutil.WriteFile(path, []byte(`[{"id": "not an ID", "address": "localhost:1"}]`), 0600)
+	if err := loaded.Load(path); err == nil {
+		t.Error("Load failed: malformed file accepted")
+	}
+}
+
+// neighborID returns a random ID sharing exactly bits leading bits with id
+func neighborID(id *KademliaID, bits int) *KademliaID {
+	neighbor := newBucket(*id, bits, bucketSize).RandomID()
+	mask := byte(0x80) >> uint(bits%8)
+	neighbor[bits/8] = neighbor[bits/8]&^mask | ^id[bits/8]&mask // The next bit differs
+	return neighbor
+}
+
+func TestTreeRoutingTable(t *testing.T) {
+	me := NewContact(NewRandomKademliaID(), "localhost:8000")
+	fixed, strict, relaxed := NewRoutingTable(me), NewTreeRoutingTable(me, 0), NewTreeRoutingTable(me, 1)
+	var contacts []Contact
+	for i := 0; i < 500; i++ {
+		contacts = append(contacts, NewContact(NewRandomKademliaID(), fmt.Sprintf("localhost:%d", 9000+i)))
+	}
+	const near = 140 // More neighbors sharing these bits with me than a Bucket holds
+	for i := 0; i < 3*bucketSize; i++ {
+		contacts = append(contacts, NewContact(neighborID(me.ID, near), fmt.Sprintf("localhost:%d", 9500+i)))
+	}
+	for _, c := range contacts {
+		fixed.AddContact(c)
+		strict.AddContact(c)
+		relaxed.AddContact(c)
+	}
+	neighbors := func(rt *RoutingTable) int {
+		n := 0
+		for _, c := range rt.Contacts() {
+			if commonPrefixLen(c.ID, me.ID) == near {
+				n++
+			}
+		}
+		return n
+	}
+	// Splitting only the Bucket of me keeps the contacts of the fixed layout
+	if n, m := len(strict.Contacts()), len(fixed.Contacts()); n != m {
+		t.Errorf("AddContact failed: tree layout holds %d contacts, fixed layout %d", n, m)
+	}
+	if n := neighbors(strict); n != bucketSize {
+		t.Errorf("AddContact failed: strict tree holds %d neighbors, expected %d", n, bucketSize)
+	}
+	// The relaxed rule keeps every neighbor
+	if n := neighbors(relaxed); n != 3*bucketSize {
+		t.Errorf("AddContact failed: relaxed tree holds %d neighbors, expected %d", n, 3*bucketSize)
+	}
+	for name, rt := range map[string]*RoutingTable{"strict": strict, "relaxed": relaxed} {
+		// The Buckets must be sorted and cover the whole ID space without overlapping
+		size := new(big.Rat)
+		for i, bucket := range rt.buckets {
+			size.Add(size, new(big.Rat).SetFrac(big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), uint(bucket.depth))))
+			if i > 0 && !rt.buckets[i-1].prefix.Less(&bucket.prefix) {
+				t.Errorf("%s: bucket %d out of order", name, i)
+			}
+			if bucket.Len() > bucketSize {
+				t.Errorf("%s: bucket %d holds %d contacts", name, i, bucket.Len())
+			}
+			for _, c := range bucket.Contacts() {
+				if !bucket.Covers(c.ID) {
+					t.Errorf("%s: contact %s out of the range of bucket %d", name, c.ID, i)
+				}
+			}
+		}
+		if size.Cmp(big.NewRat(1, 1)) != 0 {
+			t.Errorf("%s: buckets cover %s of the ID space", name, size)
+		}
+		// The closest contacts must match a search through every contact
+		target := NewRandomKademliaID()
+		var all ContactCandidates
+		for _, c := range rt.Contacts() {
+			c.CalcDistance(target)
+			all.Append([]Contact{c})
+		}
+		all.Sort()
+		expected := all.GetContacts(bucketSize)
+		closest := rt.FindClosestContacts(target, bucketSize)
+		if len(closest) != len(expected) {
+			t.Fatalf("%s: FindClosestContacts returned %d contacts, expected %d", name, len(closest), len(expected))
+		}
+		for i := range closest {
+			if !closest[i].ID.Equals(expected[i].ID) {
+				t.Errorf("%s: FindClosestContacts returned %s at %d, expected %s", name, closest[i].ID, i, expected[i].ID)
+			}
+		}
+	}
+}
+
+func TestRoutingTableSnapshot(t *testing.T) {
+	rt, id := fullBucketTable()
+	rt.AddContact(NewContact(id(bucketSize), "localhost:9000")) // Goes to the replacement cache
+	rt.AddContact(NewContact(NewKademliaID(contact6), "localhost:9001"))
+	contact := NewContact(id(1), "localhost:8002")
+	contact.LastSeen, contact.LastReplied, contact.RTT = time.Unix(1000, 0).UTC(), time.Unix(1000, 0).UTC(), 5*time.Millisecond
+	rt.AddContact(contact)
+	data, err := json.Marshal(rt.Snapshot())
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !snapshot.Me.ID.Equals(rt.Me().ID) || snapshot.Tree {
+		t.Errorf("Snapshot failed: me %s, tree %v", snapshot.Me.ID, snapshot.Tree)
+	}
+	// Only the two buckets holding contacts, sorted by range
+	if len(snapshot.Buckets) != 2 {
+		t.Fatalf("Snapshot failed: %d buckets, expected 2", len(snapshot.Buckets))
+	}
+	first, second := snapshot.Buckets[0], snapshot.Buckets[1]
+	if first.Index != 0 || first.Depth != 1 || first.Range() != "8000000000000000000000000000000000000000/1" {
+		t.Errorf("Snapshot failed: first bucket %d %s", first.Index, first.Range())
+	}
+	if second.Index != 2 || len(second.Contacts) != 1 || second.Contacts[0].Address != "localhost:9001" {
+		t.Errorf("Snapshot failed: second bucket %d %v", second.Index, second.Contacts)
+	}
+	if len(first.Contacts) != bucketSize || len(first.Replacements) != 1 || !first.Replacements[0].ID.Equals(id(bucketSize)) {
+		t.Fatalf("Snapshot failed: %d contacts, %d replacements", len(first.Contacts), len(first.Replacements))
+	}
+	// The metadata of the contacts survives the encoding
+	if got := first.Contacts[0]; !got.ID.Equals(id(1)) || !got.LastSeen.Equal(contact.LastSeen) || got.RTT != contact.RTT {
+		t.Errorf("Snapshot failed: contact %s seen at %v with RTT %v", got.ID, got.LastSeen, got.RTT)
+	}
+}
+
+// randomTable returns a RoutingTable of the layout specified holding size contacts, part
+// of them close to me, with IDs taken from r
+func randomTable(r *rand.Rand, layout int, size int) *RoutingTable {
+	randomID := func() *KademliaID {
+		id := KademliaID{}
+		r.Read(id[:])
+		return &id
+	}
+	me := NewContact(randomID(), "localhost:8000")
+	rt := NewRoutingTable(me)
+	if layout > 0 {
+		rt = NewTreeRoutingTable(me, layout-1)
+	}
+	for i := 0; i < size; i++ {
+		id := randomID()
+		if i%2 == 0 { // Share a random number of leading bits with me
+			bits := r.Intn(IDLength * 8)
+			*id = *me.ID
+			id[bits/8] ^= 0x80 >> uint(bits%8) // The first bit differing from me
+			for j := bits + 1; j < IDLength*8; j++ {
+				if r.Intn(2) == 1 {
+					id[j/8] ^= 0x80 >> uint(j%8)
+				}
+			}
+		}
+		rt.AddContact(NewContact(id, fmt.Sprintf("localhost:%d", 9000+i)))
+	}
+	return rt
+}
+
+func TestFindClosestContactsProperty(t *testing.T) {
+	// The closest contacts must match a sort of every contact, whatever the table and the target
+	property := func(seed int64, layout uint8, size uint16, count uint8) bool {
+		r := rand.New(rand.NewSource(seed))
+		rt := randomTable(r, int(layout%4), int(size%1000))
+		target := KademliaID{}
+		r.Read(target[:])
+		if layout%2 == 0 { // Targets in the table are looked up as well
+			if contacts := rt.Contacts(); len(contacts) > 0 {
+				target = *contacts[r.Intn(len(contacts))].ID
+			}
+		}
+		var all ContactCandidates
+		for _, c := range rt.Contacts() {
+			c.CalcDistance(&target)
+			all.Append([]Contact{c})
+		}
+		all.Sort()
+		expected := all.GetContacts(int(count))
+		closest := rt.FindClosestContacts(&target, int(count))
+		if len(closest) != len(expected) {
+			return false
+		}
+		for i := range closest {
+			if !closest[i].ID.Equals(expected[i].ID) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 300}); err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkFindClosestContacts(b *testing.B) {
+	for _, layout := range []struct {
+		name   string
+		layout int
+	}{{"fixed", 0}, {"tree", 1}, {"relaxed", 3}} {
+		rt := randomTable(rand.New(rand.NewSource(1)), layout.layout, 2000)
+		targets := make([]*KademliaID, 256)
+		for i := range targets {
+			targets[i] = NewRandomKademliaID()
+		}
+		b.Run(layout.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rt.FindClosestContacts(targets[i%len(targets)], bucketSize)
+			}
+		})
+	}
+}
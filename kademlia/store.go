@@ -0,0 +1,247 @@
+package kademlia
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Store definition
+// holds the values of a node by key, together with the time each one expires at.
+// The keys are in lowercase hexadecimal, as the ones of the values of the network.
+// A zero expiration time means that the value never expires. The values passed
+// to and returned by a Store are never aliased by it. Implementations must be
+// safe for concurrent use, see the storetest package for their conformance suite
+type Store interface {
+	// Put stores the value under the key, replacing the previous one, if any
+	Put(key string, value []byte, expires time.Time) error
+	// Get returns the value stored under the key and its expiration time,
+	// or ErrNotFound if there is none
+	Get(key string) ([]byte, time.Time, error)
+	// Touch changes the expiration time of the value stored under the key,
+	// or returns ErrNotFound if there is none
+	Touch(key string, expires time.Time) error
+	// Delete removes the value stored under the key, if any
+	Delete(key string) error
+	// Range calls f for every value stored, in no particular order, until f returns
+	// false. f must not modify the Store
+	Range(f func(key string, value []byte, expires time.Time) bool) error
+	// Expire removes every value whose expiration time is not after now
+	Expire(now time.Time) error
+	// Close releases the resources of the Store, which is not used afterwards
+	Close() error
+}
+
+// PublicationStore definition
+// is implemented by the Stores that also keep the values published by the node itself,
+// apart from the ones it holds, with the time each one was last published at, so that
+// a restarted node resumes republishing them
+type PublicationStore interface {
+	Store
+	// Publish records that the node published the value under the key at the time specified
+	Publish(key string, value []byte, published time.Time) error
+	// Unpublish removes the record of the value published under the key, if any
+	Unpublish(key string) error
+	// RangePublished calls f for every value published, in no particular order,
+	// until f returns false. f must not modify the Store
+	RangePublished(f func(key string, value []byte, published time.Time) bool) error
+}
+
+// storedValue definition
+// stores a value of a MemoryStore with its expiration time
+type storedValue struct {
+	value   []byte
+	expires time.Time
+}
+
+// MemoryStore definition
+// implements the Store interface with a map, the values are lost once the node stops
+type MemoryStore struct {
+	mu     sync.RWMutex
+	values map[string]storedValue
+}
+
+// NewMemoryStore returns a new instance of an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: make(map[string]storedValue)}
+}
+
+// Put stores a copy of the value under the key
+func (s *MemoryStore) Put(key string, value []byte, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = storedValue{value: append([]byte(nil), value...), expires: expires}
+	return nil
+}
+
+// Get returns a copy of the value stored under the key and its expiration time
+func (s *MemoryStore) Get(key string) ([]byte, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stored, ok := s.values[key]
+	if !ok {
+		return nil, time.Time{}, ErrNotFound
+	}
+	return append([]byte(nil), stored.value...), stored.expires, nil
+}
+
+// Touch changes the expiration time of the value stored under the key
+func (s *MemoryStore) Touch(key string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.values[key]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.expires = expires
+	s.values[key] = stored
+	return nil
+}
+
+// Delete removes the value stored under the key, if any
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+// Range calls f for a copy of every value stored until f returns false
+func (s *MemoryStore) Range(f func(key string, value []byte, expires time.Time) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, stored := range s.values {
+		if !f(key, append([]byte(nil), stored.value...), stored.expires) {
+			break
+		}
+	}
+	return nil
+}
+
+// Expire removes every value expired at now
+func (s *MemoryStore) Expire(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, stored := range s.values {
+		if expired(stored.expires, now) {
+			delete(s.values, key)
+		}
+	}
+	return nil
+}
+
+// Close does nothing, the values are simply dropped with the MemoryStore
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// expired returns true if a value with the expiration time specified is expired at now
+func expired(expires time.Time, now time.Time) bool {
+	return !expires.IsZero() && !expires.After(now)
+}
+
+// load returns the value stored under the key, if any, restarting its expiration
+// since the value is still requested. An expired value that the expiring routine has
+// not got to yet, or a value that does not match its key, corrupted in the Store, is
+// removed instead of being handed out
+func (k *Kademlia) load(key string) ([]byte, bool) {
+	data, expires, err := k.config.Store.Get(key)
+	if err != nil {
+		return nil, false
+	}
+	if expired(expires, k.config.Clock.Now()) {
+		k.config.Store.Delete(key)
+		return nil, false
+	}
+	if sum := sha1.Sum(data); hex.EncodeToString(sum[:]) != key {
+		fmt.Printf("Removing %s: %v\n", key, ErrForgedValue)
+		k.config.Store.Delete(key)
+		return nil, false
+	}
+	k.config.Store.Touch(key, k.expiration())
+	return data, true
+}
+
+// expiration returns the expiration time of a value stored or requested now
+func (k *Kademlia) expiration() time.Time {
+	return k.config.Clock.Now().Add(k.config.ExpirationDelay)
+}
+
+// timeToLive returns the time left at now to a value expiring at the time specified,
+// zero if it never expires
+func timeToLive(expires time.Time, now time.Time) time.Duration {
+	if expires.IsZero() {
+		return 0
+	}
+	return expires.Sub(now)
+}
+
+// expireValues removes the values of the Store once they expire, until the node is closed.
+// It sleeps until the earliest expiration time, or for a whole expiration delay if the Store
+// is empty. A value published or requested expires a whole delay later, after the others,
+// but a replicated one can expire sooner: its STORE wakes the routine up to look again
+func (k *Kademlia) expireValues() {
+	for {
+		now := k.config.Clock.Now()
+		if err := k.config.Store.Expire(now); err != nil {
+			fmt.Printf("Unable to expire the values: %v\n", err)
+		}
+		next := now.Add(k.config.ExpirationDelay)
+		k.config.Store.Range(func(_ string, _ []byte, expires time.Time) bool {
+			if !expires.IsZero() && expires.Before(next) {
+				next = expires
+			}
+			return true
+		})
+		select {
+		case <-k.config.Clock.After(next.Sub(now)):
+		case <-k.expiring: // A replicated value may expire first
+		case <-k.ctx.Done(): // If the node is closed
+			return
+		}
+	}
+}
+
+// publish records that the node publishes the data under the key now, if the Store keeps
+// the publications
+func (k *Kademlia) publish(key string, data []byte) {
+	if ps, ok := k.config.Store.(PublicationStore); ok {
+		if err := ps.Publish(key, data, k.config.Clock.Now()); err != nil {
+			fmt.Printf("Unable to record the publication of %s: %v\n", key, err)
+		}
+	}
+}
+
+// unpublish removes the record of the publication of the value under the key, if the Store keeps them
+func (k *Kademlia) unpublish(key string) {
+	if ps, ok := k.config.Store.(PublicationStore); ok {
+		if err := ps.Unpublish(key); err != nil {
+			fmt.Printf("Unable to remove the publication of %s: %v\n", key, err)
+		}
+	}
+}
+
+// resumeRepublishing schedules the republishing of the values published before a restart,
+// one republishing delay after they were last published or right away if that is past.
+// It is called once the node hears from another node, since before then the values
+// could not reach the network
+func (k *Kademlia) resumeRepublishing() {
+	ps, ok := k.config.Store.(PublicationStore)
+	if !ok {
+		return
+	}
+	now := k.config.Clock.Now()
+	ps.RangePublished(func(key string, value []byte, published time.Time) bool {
+		if m, ok := decodeManifest(value); ok { // Its parts are forgotten with it
+			k.parts.Store(key, m.entries)
+		}
+		delay := published.Add(k.config.RepublishDelay).Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		k.republish(key, value, delay)
+		return true
+	})
+}
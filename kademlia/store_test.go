@@ -0,0 +1,108 @@
+package kademlia_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matteocarnelos/kadlab/kademlia"
+	"github.com/matteocarnelos/kadlab/kademlia/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.TestStore(t, func(t *testing.T) kademlia.Store {
+		return kademlia.NewMemoryStore()
+	})
+}
+
+func TestFileStore(t *testing.T) {
+	storetest.TestStore(t, func(t *testing.T) kademlia.Store {
+		s, err := kademlia.NewFileStore(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewFileStore failed: %v", err)
+		}
+		return s
+	})
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "values")
+	s, err := kademlia.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	expires := time.Now().Add(time.Hour).Round(0)
+	const key = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+	s.Put(key, []byte("value"), expires)
+	s.Close()
+	// A file left behind by a crash while writing is ignored
+	ioutil.WriteFile(filepath.Join(dir, ".tmp123"), []byte("partial"), 0600)
+	if s, err = kademlia.NewFileStore(dir); err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	if value, at, err := s.Get(key); err != nil || string(value) != "value" || !at.Equal(expires) {
+		t.Errorf("Get failed: %q expiring at %v (%v)", value, at, err)
+	}
+	count := 0
+	s.Range(func(string, []byte, time.Time) bool {
+		count++
+		return true
+	})
+	if count != 1 {
+		t.Errorf("Range failed: %d values visited", count)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("NewFileStore failed: directory mode %v (%v)", info.Mode(), err)
+	}
+	// The keys name the files as they are, so only lowercase hexadecimal ones are accepted
+	if _, err := os.Stat(filepath.Join(dir, key+".value")); err != nil {
+		t.Errorf("Put failed: value file not named after the key (%v)", err)
+	}
+	for _, invalid := range []string{"", "../key", "AAF4", "abc"} {
+		if err := s.Put(invalid, []byte("value"), expires); err == nil {
+			t.Errorf("Put(%q) succeeded with an invalid key", invalid)
+		}
+	}
+}
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	mn := kademlia.NewMemoryNetwork()
+	start := func(addr string, s kademlia.Store) *kademlia.Kademlia {
+		node, err := kademlia.NewKademlia(kademlia.NewContact(kademlia.NewRandomKademliaID(), addr), kademlia.Config{Store: s})
+		if err != nil {
+			t.Fatalf("NewKademlia failed: %v", err)
+		}
+		tr, _ := mn.Listen(addr)
+		if err := node.StartTransport(tr); err != nil {
+			t.Fatalf("StartTransport failed: %v", err)
+		}
+		return node
+	}
+	startFile := func() *kademlia.Kademlia {
+		s, err := kademlia.NewFileStore(dir)
+		if err != nil {
+			t.Fatalf("NewFileStore failed: %v", err)
+		}
+		return start("127.0.0.1:62000", s)
+	}
+	holder := startFile()
+	writer := start("127.0.0.1:62001", nil)
+	defer writer.Close()
+	if err := writer.Join("127.0.0.1:62000"); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	hash, err := writer.StoreContext(context.Background(), []byte("persistent")) // The holder keeps the only replica
+	if err != nil {
+		t.Fatalf("StoreContext failed: %v", err)
+	}
+	holder.Close()
+	holder = startFile()
+	defer holder.Close()
+	if data, ok := holder.LookupData(hash); !ok || data != "persistent" {
+		t.Errorf("LookupData failed: %v not found after the restart", hash)
+	}
+}
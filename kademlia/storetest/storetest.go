@@ -0,0 +1,229 @@
+// Package storetest provides a conformance suite for the implementations of the
+// kademlia.Store interface, so that the backends shipped with the kademlia package
+// and the ones of the embedders are checked against the same expectations
+package storetest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matteocarnelos/kadlab/kademlia"
+)
+
+// MakeStore returns a new, empty Store for a test. The suite closes it
+type MakeStore func(t *testing.T) kademlia.Store
+
+// TestStore runs the conformance suite against the Stores returned by makeStore
+func TestStore(t *testing.T, makeStore MakeStore) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s kademlia.Store)
+	}{
+		{"PutGet", testPutGet},
+		{"Overwrite", testOverwrite},
+		{"Missing", testMissing},
+		{"Delete", testDelete},
+		{"Touch", testTouch},
+		{"Range", testRange},
+		{"Expire", testExpire},
+		{"Aliasing", testAliasing},
+		{"Concurrent", testConcurrent},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := makeStore(t)
+			defer func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("Close failed: %v", err)
+				}
+			}()
+			test.test(t, s)
+		})
+	}
+}
+
+// expiration is an arbitrary expiration time, truncated as any backend can keep it
+var expiration = time.Date(2030, 1, 2, 3, 4, 5, 6000, time.UTC)
+
+// keyOf returns the key of a test value named as specified, in lowercase hexadecimal
+// as every key of a Store
+func keyOf(name string) string {
+	return hex.EncodeToString([]byte(name))
+}
+
+// mustPut stores the value under the key or fails the test
+func mustPut(t *testing.T, s kademlia.Store, key string, value []byte, expires time.Time) {
+	t.Helper()
+	if err := s.Put(key, value, expires); err != nil {
+		t.Fatalf("Put(%q) failed: %v", key, err)
+	}
+}
+
+// checkGet fails the test unless the value stored under the key and its expiration time are the ones specified
+func checkGet(t *testing.T, s kademlia.Store, key string, value []byte, expires time.Time) {
+	t.Helper()
+	got, gotExpires, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q) failed: %v", key, err)
+	}
+	if !bytes.Equal(got, value) || !gotExpires.Equal(expires) {
+		t.Errorf("Get(%q) = %q expiring at %v, expected %q expiring at %v", key, got, gotExpires, value, expires)
+	}
+}
+
+// checkMissing fails the test unless no value is stored under the key
+func checkMissing(t *testing.T, s kademlia.Store, key string) {
+	t.Helper()
+	if _, _, err := s.Get(key); !errors.Is(err, kademlia.ErrNotFound) {
+		t.Errorf("Get(%q) returned %v instead of ErrNotFound", key, err)
+	}
+}
+
+func testPutGet(t *testing.T, s kademlia.Store) {
+	mustPut(t, s, "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", []byte("hello"), expiration)
+	checkGet(t, s, "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", []byte("hello"), expiration)
+	// Empty and binary values, values that never expire
+	mustPut(t, s, keyOf("empty"), nil, expiration)
+	checkGet(t, s, keyOf("empty"), nil, expiration)
+	binary := []byte{0, 1, 2, 0xfe, 0xff, '\n'}
+	mustPut(t, s, keyOf("binary"), binary, time.Time{})
+	checkGet(t, s, keyOf("binary"), binary, time.Time{})
+}
+
+func testOverwrite(t *testing.T, s kademlia.Store) {
+	mustPut(t, s, keyOf("key"), []byte("first"), expiration)
+	mustPut(t, s, keyOf("key"), []byte("second"), expiration.Add(time.Hour))
+	checkGet(t, s, keyOf("key"), []byte("second"), expiration.Add(time.Hour))
+}
+
+func testMissing(t *testing.T, s kademlia.Store) {
+	checkMissing(t, s, keyOf("missing"))
+	if err := s.Touch(keyOf("missing"), expiration); !errors.Is(err, kademlia.ErrNotFound) {
+		t.Errorf("Touch returned %v instead of ErrNotFound", err)
+	}
+}
+
+func testDelete(t *testing.T, s kademlia.Store) {
+	mustPut(t, s, keyOf("key"), []byte("value"), expiration)
+	mustPut(t, s, keyOf("other"), []byte("value"), expiration)
+	if err := s.Delete(keyOf("key")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	checkMissing(t, s, keyOf("key"))
+	checkGet(t, s, keyOf("other"), []byte("value"), expiration)
+	// Deleting a missing value is harmless
+	if err := s.Delete(keyOf("key")); err != nil {
+		t.Errorf("Delete of a missing value failed: %v", err)
+	}
+}
+
+func testTouch(t *testing.T, s kademlia.Store) {
+	mustPut(t, s, keyOf("key"), []byte("value"), expiration)
+	later := expiration.Add(24 * time.Hour)
+	if err := s.Touch(keyOf("key"), later); err != nil {
+		t.Fatalf("Touch failed: %v", err)
+	}
+	checkGet(t, s, keyOf("key"), []byte("value"), later)
+	if err := s.Touch(keyOf("key"), time.Time{}); err != nil {
+		t.Fatalf("Touch failed: %v", err)
+	}
+	checkGet(t, s, keyOf("key"), []byte("value"), time.Time{})
+}
+
+func testRange(t *testing.T, s kademlia.Store) {
+	const count = 20
+	for i := 0; i < count; i++ {
+		mustPut(t, s, keyOf(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)), expiration.Add(time.Duration(i)*time.Second))
+	}
+	seen := make(map[string]bool)
+	err := s.Range(func(key string, value []byte, expires time.Time) bool {
+		var i int
+		name, _ := hex.DecodeString(key)
+		if _, err := fmt.Sscanf(string(name), "key%d", &i); err != nil || seen[key] {
+			t.Errorf("Range visited %q", key)
+		}
+		if string(value) != fmt.Sprintf("value%d", i) || !expires.Equal(expiration.Add(time.Duration(i)*time.Second)) {
+			t.Errorf("Range visited %q with %q expiring at %v", key, value, expires)
+		}
+		seen[key] = true
+		return true
+	})
+	if err != nil || len(seen) != count {
+		t.Errorf("Range visited %d values instead of %d (%v)", len(seen), count, err)
+	}
+	// Returning false stops the iteration
+	visited := 0
+	s.Range(func(string, []byte, time.Time) bool {
+		visited++
+		return visited < 5
+	})
+	if visited != 5 {
+		t.Errorf("Range visited %d values after being stopped at 5", visited)
+	}
+}
+
+func testExpire(t *testing.T, s kademlia.Store) {
+	mustPut(t, s, keyOf("past"), []byte("value"), expiration.Add(-time.Second))
+	mustPut(t, s, keyOf("now"), []byte("value"), expiration)
+	mustPut(t, s, keyOf("future"), []byte("value"), expiration.Add(time.Second))
+	mustPut(t, s, keyOf("never"), []byte("value"), time.Time{})
+	if err := s.Expire(expiration); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+	checkMissing(t, s, keyOf("past"))
+	checkMissing(t, s, keyOf("now"))
+	checkGet(t, s, keyOf("future"), []byte("value"), expiration.Add(time.Second))
+	checkGet(t, s, keyOf("never"), []byte("value"), time.Time{})
+}
+
+func testAliasing(t *testing.T, s kademlia.Store) {
+	value := []byte("value")
+	mustPut(t, s, keyOf("key"), value, expiration)
+	value[0] = 'X' // The Store keeps its own copy
+	got, _, _ := s.Get(keyOf("key"))
+	checkGet(t, s, keyOf("key"), []byte("value"), expiration)
+	got[0] = 'Y' // And hands out copies
+	checkGet(t, s, keyOf("key"), []byte("value"), expiration)
+	s.Range(func(_ string, value []byte, _ time.Time) bool {
+		value[0] = 'Z'
+		return true
+	})
+	checkGet(t, s, keyOf("key"), []byte("value"), expiration)
+}
+
+func testConcurrent(t *testing.T, s kademlia.Store) {
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := keyOf(fmt.Sprintf("key%d", i%10))
+				value := []byte(fmt.Sprintf("value%d", i%10))
+				if err := s.Put(key, value, expiration); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+				if got, _, err := s.Get(key); err == nil && !bytes.Equal(got, value) {
+					t.Errorf("Get(%q) = %q, expected %q", key, got, value)
+					return
+				}
+				switch w % 3 {
+				case 0:
+					s.Touch(key, expiration.Add(time.Second))
+				case 1:
+					s.Delete(key)
+				default:
+					s.Range(func(string, []byte, time.Time) bool { return true })
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
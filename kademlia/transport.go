@@ -0,0 +1,78 @@
+package kademlia
+
+import (
+	"net"
+	"strconv"
+)
+
+// Transport definition
+// abstracts the datagram layer the Network sends and receives its messages through.
+// Addresses are always in the "host:port" form
+type Transport interface {
+	// WriteTo sends the datagram to the address specified. Delivery is not guaranteed
+	WriteTo(data []byte, addr string) error
+	// ReadFrom blocks until a datagram is received, copies it into buf and
+	// returns its size and the address of the sender
+	ReadFrom(buf []byte) (int, string, error)
+	// LocalAddr returns the address the transport is bound to
+	LocalAddr() string
+	// Close stops the transport, unblocking any pending ReadFrom
+	Close() error
+}
+
+// UDPTransport definition
+// implements the Transport over a UDP socket
+type UDPTransport struct {
+	conn *net.UDPConn
+}
+
+// ListenUDP returns a new instance of a UDPTransport bound to the ip and port specified
+func ListenUDP(ip string, port int) (*UDPTransport, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+	if err != nil {
+		return nil, err
+	}
+	return &UDPTransport{conn: conn}, nil
+}
+
+// WriteTo sends the datagram to the UDP address specified
+func (t *UDPTransport) WriteTo(data []byte, addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.WriteToUDP(data, udpAddr)
+	return err
+}
+
+// ReadFrom blocks until a datagram is received from the socket
+func (t *UDPTransport) ReadFrom(buf []byte) (int, string, error) {
+	size, addr, err := t.conn.ReadFromUDP(buf)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, addr.String(), nil
+}
+
+// LocalAddr returns the address of the socket
+func (t *UDPTransport) LocalAddr() string {
+	return t.conn.LocalAddr().String()
+}
+
+// Close closes the socket
+func (t *UDPTransport) Close() error {
+	return t.conn.Close()
+}
+
+// splitAddr splits a "host:port" address into its ip and port
+func splitAddr(addr string) (net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return net.ParseIP(host), port, nil
+}
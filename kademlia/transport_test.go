@@ -0,0 +1,111 @@
+package kademlia
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+)
+
+const clusterSize = 100
+
+// newTestNode starts a node with the ID specified on the MemoryNetwork,
+// listening on the local host at the port specified
+func newTestNode(t *testing.T, mn *MemoryNetwork, id *KademliaID, port int) *Kademlia {
+	return newTestNodeConfig(t, mn, id, port, Config{})
+}
+
+// newTestNodeConfig is like newTestNode but with the protocol parameters of the config
+func newTestNodeConfig(t *testing.T, mn *MemoryNetwork, id *KademliaID, port int, config Config) *Kademlia {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	node, err := NewKademlia(NewContact(id, addr), config)
+	if err != nil {
+		t.Fatalf("NewKademlia failed: %v", err)
+	}
+	tr, err := mn.Listen(addr)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	if err := node.StartTransport(tr); err != nil {
+		t.Fatalf("StartTransport failed: %v", err)
+	}
+	return node
+}
+
+// newTestCluster starts size nodes with random IDs on a MemoryNetwork, all of
+// them on the same host, and joins them to the network through the first one
+func newTestCluster(t *testing.T, size int) []*Kademlia {
+	return newTestClusterConfig(t, size, Config{})
+}
+
+// newTestClusterConfig is like newTestCluster but with the protocol parameters of the config
+func newTestClusterConfig(t *testing.T, size int, config Config) []*Kademlia {
+	mn := NewMemoryNetwork()
+	nodes := make([]*Kademlia, size)
+	for i := range nodes {
+		nodes[i] = newTestNodeConfig(t, mn, NewRandomKademliaID(), listenPort+i, config)
+		if i > 0 { // Join through the first node
+			if err := nodes[i].Join(nodes[0].Net.RT.me.Address); err != nil {
+				t.Fatalf("Join failed: %v", err)
+			}
+		}
+	}
+	return nodes
+}
+
+func TestMemoryTransport(t *testing.T) {
+	mn := NewMemoryNetwork()
+	a, _ := mn.Listen("10.0.0.1:1")
+	b, _ := mn.Listen("10.0.0.2:1")
+	// Binding an address twice should fail
+	if _, err := mn.Listen("10.0.0.1:1"); err == nil {
+		t.Error("Listen failed: address bound twice")
+	}
+	// Datagrams should be delivered with the sender's address
+	a.WriteTo([]byte(objContent), b.LocalAddr())
+	buf := make([]byte, bufferSize)
+	size, from, err := b.ReadFrom(buf)
+	if err != nil || string(buf[:size]) != objContent || from != a.LocalAddr() {
+		t.Error("ReadFrom failed: wrong datagram received")
+	}
+	// Datagrams to unknown addresses are silently lost
+	if err := a.WriteTo([]byte(objContent), "10.0.0.3:1"); err != nil {
+		t.Errorf("WriteTo failed: %v", err)
+	}
+	// Closing should unblock the reader and release the address
+	b.Close()
+	if _, _, err := b.ReadFrom(buf); err == nil {
+		t.Error("ReadFrom failed: closed transport still readable")
+	}
+	if _, err := mn.Listen(b.LocalAddr()); err != nil {
+		t.Error("Close failed: address not released")
+	}
+}
+
+func TestClusterStoreAndLookup(t *testing.T) {
+	nodes := newTestCluster(t, clusterSize)
+	for i := 0; i < 5; i++ {
+		data := fmt.Sprintf("object %d stored from node %d", i, i)
+		h := sha1.Sum([]byte(data))
+		hash := hex.EncodeToString(h[:])
+		if key := nodes[i].Store([]byte(data)); key != hash {
+			t.Errorf("Store failed: expected key %s, %s returned", hash, key)
+		}
+		// Any other node should be able to find the object
+		reader := nodes[len(nodes)-1-i]
+		if found, ok := reader.LookupData(hash); !ok || found != data {
+			t.Errorf("LookupData failed: object %d not found from node %d", i, len(nodes)-1-i)
+		}
+	}
+	// Every node should find the last node among the closest to its ID
+	last := nodes[len(nodes)-1].Net.RT.me
+	for _, c := range nodes[1].LookupContact(last.ID) {
+		if c.ID.Equals(last.ID) {
+			return
+		}
+	}
+	t.Error("LookupContact failed: target node not found")
+}
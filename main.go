@@ -2,16 +2,19 @@ package main
 
 import (
 	"bufio"
-	"crypto/sha1"
+	"context"
 	"encoding/csv"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/matteocarnelos/kadlab/kademlia"
-	"io/ioutil"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -21,17 +24,68 @@ const BNHost = 3 // Bootstrap Node Identifier
 const ListenPort = 62000
 const ListenIP = "0.0.0.0"
 const ListenDelaySec = 5
+const ShutdownTimeoutSec = 10
+const RoutesSaveSec = 60 // Period for saving the routing table
 
 const CLIPrefix = ">>>"
 
+var IDSource = flag.String("id", "random", "source of the node identity: random, file or key")
+var IDPath = flag.String("id-path", "kademlia.id", "file storing the node identity (file and key sources)")
+var RoutesPath = flag.String("routes-path", "kademlia.routes", "file storing the routing table across restarts")
+var RoutesLayout = flag.String("routes", "fixed", "layout of the routing table: fixed or tree")
+var StorePath = flag.String("store-path", "", "directory storing the values across restarts, none to keep them in memory")
+var StoreFormat = flag.String("store", "log", "format of the values under -store-path: log or files")
+
+var NodeConfig = kademlia.DefaultConfig() // Protocol parameters, filled from the flags below
+
+func init() {
+	flag.IntVar(&NodeConfig.Alpha, "alpha", NodeConfig.Alpha, "concurrency of the lookups")
+	flag.IntVar(&NodeConfig.K, "k", NodeConfig.K, "contacts returned by the lookups and nodes storing each value")
+	flag.IntVar(&NodeConfig.BucketSize, "bucket-size", NodeConfig.BucketSize, "contacts per bucket of the routing table")
+	flag.DurationVar(&NodeConfig.RepublishDelay, "republish-delay", NodeConfig.RepublishDelay, "delay for publishing the values published by the node again")
+	flag.DurationVar(&NodeConfig.ExpirationDelay, "expiration-delay", NodeConfig.ExpirationDelay, "delay for deleting the values not refreshed")
+	flag.DurationVar(&NodeConfig.RefreshInterval, "refresh-interval", NodeConfig.RefreshInterval, "delay for refreshing the buckets not used by any lookup")
+	flag.DurationVar(&NodeConfig.ReplicateInterval, "replicate-interval", NodeConfig.ReplicateInterval, "delay for replicating the held values not stored again")
+	flag.DurationVar(&NodeConfig.PingTimeout, "ping-timeout", NodeConfig.PingTimeout, "timeout for the PING RPC")
+	flag.DurationVar(&NodeConfig.FindTimeout, "find-timeout", NodeConfig.FindTimeout, "timeout for the FIND_NODE and FIND_VALUE RPCs")
+	flag.DurationVar(&NodeConfig.StoreTimeout, "store-timeout", NodeConfig.StoreTimeout, "timeout for the STORE RPC")
+	flag.DurationVar(&NodeConfig.StallTimeout, "stall-timeout", NodeConfig.StallTimeout, "time after which a lookup stops waiting for an RPC")
+	flag.IntVar(&NodeConfig.BufferSize, "buffer-size", NodeConfig.BufferSize, "size of the buffer receiving the messages")
+	flag.IntVar(&NodeConfig.ChunkSize, "chunk-size", 0, "size of the chunks of the large objects, 0 for the largest fitting the buffer up to 4096")
+	flag.IntVar(&NodeConfig.RelaxedDepth, "relaxed-depth", 0, "levels above the own bucket whose buckets the tree layout splits too")
+	flag.IntVar(&NodeConfig.Diversity.BucketIP, "bucket-ip-limit", 0, "contacts per IP address in a bucket, 0 for no limit")
+	flag.IntVar(&NodeConfig.Diversity.BucketSubnet, "bucket-subnet-limit", 0, "contacts per /24 or /64 subnet in a bucket, 0 for no limit")
+	flag.IntVar(&NodeConfig.Diversity.TableIP, "table-ip-limit", 0, "contacts per IP address in the routing table, 0 for no limit")
+	flag.IntVar(&NodeConfig.Diversity.TableSubnet, "table-subnet-limit", 0, "contacts per /24 or /64 subnet in the routing table, 0 for no limit")
+}
+
+// parseFlags parses the command line. Every flag missing from it is taken from the
+// environment variable named after it, if any: KADEMLIA_ID_PATH for -id-path
+func parseFlags() error {
+	flag.Parse()
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := "KADEMLIA_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if set[f.Name] || !ok || err != nil {
+			return
+		}
+		if e := f.Value.Set(value); e != nil {
+			err = fmt.Errorf("%s: %v", name, e)
+		}
+	})
+	return err
+}
+
 var kdm *kademlia.Kademlia
 
 // handleRequest treats both GET and POST requests for respectively getting the
-// information and storing it
+// information and storing it. The objects, of any size, are streamed both ways
 func handleRequest(w http.ResponseWriter, r *http.Request) {
 	ip := strings.Split(r.RemoteAddr, ":")[0]
-	body, _ := ioutil.ReadAll(r.Body)
-	fmt.Printf("\n%s -> [%s %s %s] %s\n", ip, r.Method, r.URL, r.Proto, body)
+	fmt.Printf("\n%s -> [%s %s %s]\n", ip, r.Method, r.URL, r.Proto)
 	var msg string
 	var code int
 	switch r.Method {
@@ -42,20 +96,33 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 			msg = "Invalid hash, please provide a valid 160-bit data hash"
 			break
 		}
-		if content, ok := load(hash); ok {
-			code = http.StatusOK
-			msg = content
-		} else {
+		fmt.Println("Finding object...")
+		out := &countingWriter{w: w}
+		err := kdm.LookupObjectContext(r.Context(), hash, out)
+		switch {
+		case err == nil:
+			if out.n == 0 { // Nothing written for an empty object
+				w.WriteHeader(http.StatusOK)
+			}
+			fmt.Printf("[%s %d %s] %d bytes sent -> %s\n\n", r.Proto, http.StatusOK, http.StatusText(http.StatusOK), out.n, ip)
+			return
+		case out.n > 0: // Too late for an error status, cut the response short
+			fmt.Printf("[%s aborted] %v after %d bytes -> %s\n\n", r.Proto, err, out.n, ip)
+			panic(http.ErrAbortHandler)
+		case errors.Is(err, kademlia.ErrNotFound):
 			code = http.StatusNotFound
 			msg = "Object not found"
+		default:
+			code = http.StatusInternalServerError
+			msg = err.Error()
 		}
 	case "POST":
-		if len(body) > 255 {
-			code = http.StatusBadRequest
-			msg = "Invalid object size, maximum size is 255 bytes"
+		hash, err := store(r.Context(), r.Body)
+		if err != nil {
+			code = http.StatusServiceUnavailable
+			msg = err.Error()
 			break
 		}
-		hash := store(string(body))
 		w.Header().Set("Location", "/objects/"+hash)
 		code = http.StatusCreated
 		msg = "Object stored!"
@@ -65,36 +132,144 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("[%s %d %s] %s -> %s\n\n", r.Proto, code, http.StatusText(code), msg, ip)
 }
 
-// store calls to the service layer for storing the content
-func store(content string) string {
+// countingWriter definition
+// counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// handleRoutes treats GET requests for the snapshot of the routing table, encoded in JSON
+func handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := json.MarshalIndent(kdm.Net.RT.Snapshot(), "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// printRoutes prints the snapshot of the routing table, bucket by bucket
+func printRoutes() {
+	snapshot := kdm.Net.RT.Snapshot()
+	fmt.Printf("Me: %s %s\n", snapshot.Me.ID, snapshot.Me.Address)
+	for _, b := range snapshot.Buckets {
+		fmt.Printf("Bucket %d %s: %d contacts, %d replacements\n", b.Index, b.Range(), len(b.Contacts), len(b.Replacements))
+		for _, c := range b.Contacts {
+			printContact("  ", c)
+		}
+		for _, c := range b.Replacements {
+			printContact("  (replacement) ", c)
+		}
+	}
+	r := snapshot.Rejected
+	fmt.Printf("Rejected: %d by IP, %d by subnet in buckets, %d by IP, %d by subnet in the table\n\n",
+		r.BucketIP, r.BucketSubnet, r.TableIP, r.TableSubnet)
+}
+
+// printContact prints a contact of the routing table with its liveness metadata
+func printContact(prefix string, c kademlia.Contact) {
+	seen := "never"
+	if !c.LastSeen.IsZero() {
+		seen = time.Since(c.LastSeen).Round(time.Second).String() + " ago"
+	}
+	fmt.Printf("%s%s %s seen %s, rtt %v, %d failures\n", prefix, c.ID, c.Address, seen, c.RTT, c.Failures)
+}
+
+// store calls to the service layer for storing the content read from r,
+// giving up when the context is done
+func store(ctx context.Context, r io.Reader) (string, error) {
 	fmt.Println("Storing object...")
-	hash := kdm.Store([]byte(content))
+	hash, err := kdm.StoreObjectContext(ctx, r)
+	if err != nil {
+		return hash, err
+	}
 	fmt.Println("Object stored!")
 	fmt.Println()
-	return hash
+	return hash, nil
 }
 
 // load calls to the service layer for finding the object associated
-// with the hash
-func load(hash string) (string, bool) {
+// with the hash, giving up when the context is done
+func load(ctx context.Context, hash string) (string, error) {
 	fmt.Println("Finding object...")
-	if data, ok := kdm.LookupData(hash); ok {
-		fmt.Println("Object found!")
-		fmt.Println()
-		return data.(string), true
+	data, err := kdm.LookupDataContext(ctx, hash)
+	if err != nil {
+		return "", err
+	}
+	fmt.Println("Object found!")
+	fmt.Println()
+	return string(data), nil
+}
+
+// loadID obtains the ID of the node from the source specified
+func loadID(source, path string) (*kademlia.KademliaID, error) {
+	switch source {
+	case "random":
+		return kademlia.NewRandomKademliaID(), nil
+	case "file":
+		return kademlia.LoadIdentity(path)
+	case "key":
+		id, _, err := kademlia.LoadKeyPairIdentity(path)
+		return id, err
+	}
+	return nil, fmt.Errorf("unknown identity source: %s", source)
+}
+
+// rejoin reloads the routing table saved before the last restart and
+// rejoins the network through the peers that are still alive
+func rejoin() error {
+	if err := kdm.Net.RT.Load(*RoutesPath); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Unable to load the routing table: %v\n", err)
+		}
+		return err
+	}
+	fmt.Println("Rejoining network...")
+	err := kdm.Rejoin()
+	if err != nil {
+		fmt.Printf("Unable to rejoin the network: %v\n", err)
+	}
+	return err
+}
+
+// saveRoutes saves the routing table periodically, so that the node
+// can rejoin the network after a restart even if it crashed
+func saveRoutes() {
+	for range time.Tick(RoutesSaveSec * time.Second) {
+		if err := kdm.Net.RT.Save(*RoutesPath); err != nil {
+			fmt.Printf("Unable to save the routing table: %v\n", err)
+		}
 	}
-	return "", false
 }
 
 func main() {
+	if err := parseFlags(); err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
 	iface, _ := net.InterfaceByName("eth0") // Obtain the interface
 	addrs, _ := iface.Addrs()
 	ip := addrs[0].(*net.IPNet).IP.To4() // Obtain one address of the interface
 	isBN := ip[3] == BNHost
-	rand.Seed(int64(ip[3]))
-	h := sha1.New()
-	h.Write(ip)
-	id := kademlia.NewKademliaID(hex.EncodeToString(h.Sum(nil))) // Obtain the ID of the node
+	rand.Seed(time.Now().UnixNano())      // Only used for the join delay, IDs come from crypto/rand
+	id, err := loadID(*IDSource, *IDPath) // Obtain the ID of the node
+	if err != nil {
+		fmt.Printf("Unable to load the node identity: %v\n", err)
+		os.Exit(1)
+	}
 
 	fmt.Printf("IP Address: %s", ip)
 	if isBN {
@@ -104,26 +279,59 @@ func main() {
 	fmt.Println()
 
 	// Create the kademlia object that defines the logic of the service
-	me := kademlia.NewContact(id, ip.String())
-	kdm = kademlia.NewKademlia(me)
-	kdm.StartListen(ListenIP, ListenPort)
+	me := kademlia.NewContact(id, net.JoinHostPort(ip.String(), strconv.Itoa(ListenPort)))
+	switch *RoutesLayout {
+	case "fixed":
+	case "tree": // Keep more contacts in the neighborhood of the node
+		NodeConfig.TreeRoutes = true
+	default:
+		fmt.Printf("Unknown routing table layout: %s\n", *RoutesLayout)
+		os.Exit(1)
+	}
+	if *StorePath != "" { // Keep the values held by the node for the next start
+		switch *StoreFormat {
+		case "log": // Also resume republishing the values published by the node
+			NodeConfig.Store, err = kademlia.NewLogStore(*StorePath)
+		case "files":
+			NodeConfig.Store, err = kademlia.NewFileStore(*StorePath)
+		default:
+			err = fmt.Errorf("unknown format %s", *StoreFormat)
+		}
+		if err != nil {
+			fmt.Printf("Unable to open the store: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if kdm, err = kademlia.NewKademlia(me, NodeConfig); err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if err := kdm.StartListen(ListenIP, ListenPort); err != nil {
+		fmt.Printf("Unable to listen: %v\n", err)
+		os.Exit(1)
+	}
 	delay := time.Duration(ListenDelaySec + rand.Intn(5))
 	time.Sleep(delay * time.Second)
 
-	if !isBN { // If it is not the Bootstrap Node
+	if err := rejoin(); err == nil { // Contact the peers known before the restart, if any
+		fmt.Println("Network rejoined!")
+		fmt.Println()
+	} else if !isBN { // If it is not the Bootstrap Node
 		fmt.Println("Joining network...")
 		BNIp := net.IP{ip[0], ip[1], ip[2], BNHost} // Define the Bootstrap Node's IP
-		h = sha1.New()
-		h.Write(BNIp)
-		BNId := kademlia.NewKademliaID(hex.EncodeToString(h.Sum(nil)))
-		kdm.Net.RT.AddContact(kademlia.NewContact(BNId, BNIp.String())) // Add the BN to the routing table
-		kdm.LookupContact(me.ID)                                        // Initiate a lookup
+		BNAddr := net.JoinHostPort(BNIp.String(), strconv.Itoa(ListenPort))
+		if err := kdm.Join(BNAddr); err != nil { // Contact the BN and initiate a lookup
+			fmt.Printf("Unable to join the network: %v\n", err)
+			os.Exit(1)
+		}
 		fmt.Println("Network joined!")
 		fmt.Println()
 	}
+	go saveRoutes()
 
 	http.HandleFunc("/objects", handleRequest)
 	http.HandleFunc("/objects/", handleRequest)
+	http.HandleFunc("/node/routes", handleRoutes)
 	go http.ListenAndServe(":80", nil)
 
 	scanner := bufio.NewScanner(os.Stdin)
@@ -146,11 +354,11 @@ func main() {
 				fmt.Println("Usage: put <data>")
 				break
 			}
-			if len(args[0]) > 255 {
-				fmt.Println("Invalid object size, maximum size is 255 bytes")
+			hash, err := store(context.Background(), strings.NewReader(args[0]))
+			if err != nil {
+				fmt.Printf("Unable to store the object: %v\n\n", err)
 				break
 			}
-			hash := store(args[0])
 			fmt.Printf("Object hash: %s\n\n", hash)
 		case "get":
 			if len(args) != 1 {
@@ -162,10 +370,14 @@ func main() {
 				fmt.Println("Invalid hash, please provide a valid 160-bit data hash")
 				break
 			}
-			if content, ok := load(args[0]); ok {
+			content, err := load(context.Background(), args[0])
+			switch {
+			case err == nil:
 				fmt.Printf("Object content: %s\n\n", content)
-			} else {
+			case errors.Is(err, kademlia.ErrNotFound):
 				fmt.Printf("Object not found\n\n")
+			default:
+				fmt.Printf("Unable to find the object: %v\n\n", err)
 			}
 		case "forget":
 			if len(args) != 1 {
@@ -182,8 +394,15 @@ func main() {
 			} else {
 				fmt.Printf("Operation not allowed: not the original publisher\n\n")
 			}
+		case "routes":
+			printRoutes()
 		case "":
 		case "exit":
+			fmt.Println("Leaving network...")
+			kdm.Net.RT.Save(*RoutesPath) // Keep the known peers for the next start
+			ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeoutSec*time.Second)
+			kdm.Shutdown(ctx) // Hand off the objects held by the node
+			cancel()
 			os.Exit(0)
 		default:
 			fmt.Printf("Command not found: %s\n", cmd)